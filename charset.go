@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+
+// A file in a directory that names the charset of the encoding-0
+// text in the directory's files, for when it isn't ISO-8859-1.
+const CHARSETFILE = ".edid3-charset"
+
+
+// canonicalCharset returns the name the charset is known by here.
+func canonicalCharset(name string) (string, bool) {
+	names := map[string]string{
+		"iso-8859-1": "iso-8859-1", "latin1": "iso-8859-1",
+		"cp1251": "cp1251", "windows-1251": "cp1251",
+		"cp1252": "cp1252", "windows-1252": "cp1252",
+		"shift-jis": "shift-jis", "sjis": "shift-jis", "cp932": "shift-jis",
+		"gbk": "gbk", "cp936": "gbk",
+		"utf-8": "utf-8", "utf8": "utf-8",
+	}
+	charset, present := names[strings.ToLower(strings.TrimSpace(name))]
+	return charset, present
+}
+
+// charsetForFile returns the charset to read the file's encoding-0
+// text as: the one the options give, or the one its directory's
+// `CHARSETFILE` gives. It's empty if neither gives one.
+func charsetForFile(path string, options Options) (string, error) {
+	if options.Charset != "" {
+		return options.Charset, nil
+	}
+
+	charset_path := filepath.Join(filepath.Dir(path), CHARSETFILE)
+	data, err := ioutil.ReadFile(charset_path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.New(fmt.Sprintf("Can't read charset file '%s' (%s).", charset_path, err))
+	}
+	charset, present := canonicalCharset(string(data))
+	if !present {
+		return "", errors.New(fmt.Sprintf("Unrecognized charset '%s' in '%s'.", strings.TrimSpace(string(data)), charset_path))
+	}
+	return charset, nil
+}
+
+// decodeCharset returns the text in the charset as UTF-8. Bytes that
+// aren't characters in the charset become U+FFFD.
+func decodeCharset(data []byte, charset string) string {
+	if charset == "cp1251" {
+		return decodeSingleByte(data, cp1251Table)
+	} else if charset == "cp1252" {
+		return decodeSingleByte(data, cp1252Table)
+	} else if charset == "shift-jis" {
+		return decodeDoubleByte(data, shiftJISRows, func (b byte) rune {
+			// Half-width katakana.
+			if ((b >= 0xA1) && (b <= 0xDF)) {
+				return 0xFF61 + rune(b - 0xA1)
+			}
+			return utf8.RuneError
+		})
+	} else if charset == "gbk" {
+		return decodeDoubleByte(data, gbkRows, func (b byte) rune {
+			if b == 0x80 {
+				return '€'
+			}
+			return utf8.RuneError
+		})
+	} else if charset == "utf-8" {
+		return strings.ToValidUTF8(string(data), string(utf8.RuneError))
+	}
+	return ISO8859_1ToUTF8(data)
+}
+
+func decodeSingleByte(data []byte, table []rune) string {
+	p := make([]rune, len(data))
+	for i, b := range data {
+		if b < 0x80 {
+			p[i] = rune(b)
+		} else {
+			p[i] = table[b - 0x80]
+		}
+	}
+	return string(p)
+}
+
+// decodeDoubleByte decodes text in a charset whose characters are one
+// or two bytes. `rows` gives the characters of each lead byte, and
+// `single` those of the other bytes that aren't ASCII.
+func decodeDoubleByte(data []byte, rows map[byte]string, single func(byte) rune) string {
+	var p []rune
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		row, lead := rows[b]
+		if b < 0x80 {
+			p = append(p, rune(b))
+		} else if ((lead) && (i + 1 < len(data)) && (data[i + 1] >= 0x40)) {
+			trail := []rune(row)
+			if int(data[i + 1] - 0x40) < len(trail) {
+				p = append(p, trail[data[i + 1] - 0x40])
+			} else {
+				p = append(p, utf8.RuneError)
+			}
+			i++
+		} else {
+			p = append(p, single(b))
+		}
+	}
+	return string(p)
+}
+
+// hasHighBytes checks whether the data has bytes outside ASCII, which
+// is where the charsets differ.
+func hasHighBytes(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyTexts returns the text of the tag's encoding-0 text, comment
+// and lyrics frames that isn't ASCII.
+func legacyTexts(tag ID3v2Tag) [][]byte {
+	var texts [][]byte
+	for _, frame := range tag.Frames {
+		id := frame.Header.Id
+		body := frame.Body
+		if ((len(body) < 1) || (body[0] != 0) || (!isFrameReadable(frame)) || (!hasHighBytes(body))) {
+			continue
+		}
+		if id[0:1] == "T" {
+			texts = append(texts, body[1:])
+		} else if ((isLangTextFrame(id)) && (len(body) >= 4)) {
+			texts = append(texts, body[4:])
+		}
+	}
+	return texts
+}
+
+// recodeTag reads the tag's encoding-0 text, comment and lyrics frames
+// as the charset, and stores them as Unicode: UTF-8 in v2.4 tags, and
+// UTF-16 in others. Of a user-defined URL frame, only the description
+// is recoded, since the URL is always ISO-8859-1. It returns how many
+// frames it changed. The frames are written that way with the tag.
+func recodeTag(tag *ID3v2Tag, charset string) int {
+	if ((charset == "") || (charset == "iso-8859-1")) {
+		return 0
+	}
+	var encoding byte = 1
+	if tag.Header.Version == 4 {
+		encoding = 3
+	}
+
+	count := 0
+	for i, frame := range tag.Frames {
+		id := frame.Header.Id
+		body := frame.Body
+		if ((len(body) < 1) || (body[0] != 0) || (!isFrameReadable(frame)) || (!hasHighBytes(body))) {
+			continue
+		}
+
+		// NULs are decoded as NULs, so terminators become those of
+		// the new encoding.
+		recoded := []byte{encoding}
+		if id[0:1] == "T" {
+			recoded = append(recoded, encodeTextParts(decodeCharset(body[1:], charset), encoding, -1)...)
+		} else if ((isLangTextFrame(id)) && (len(body) >= 4)) {
+			recoded = append(recoded, body[1:4]...)
+			recoded = append(recoded, encodeTextParts(decodeCharset(body[4:], charset), encoding, 2)...)
+		} else if isUserDefinedFrame(id) {
+			end := 1 + strings.IndexByte(string(body[1:]), 0)
+			if ((end < 1) || (!hasHighBytes(body[1:end]))) {
+				continue
+			}
+			recoded = append(recoded, encodeStringAs(decodeCharset(body[1:end], charset), encoding)...)
+			if encoding == 1 {
+				recoded = append(recoded, 0, 0)
+			} else {
+				recoded = append(recoded, 0)
+			}
+			recoded = append(recoded, body[end + 1:]...)
+		} else {
+			continue
+		}
+		tag.Frames[i].Body = recoded
+		tag.Frames[i].Header.Size = len(recoded)
+		count++
+	}
+	return count
+}
+
+// encodeTextParts encodes the parts of the text separated by NULs,
+// each with its own BOM if they're UTF-16, as the description and
+// values of a frame should be. `n` limits the parts as for
+// `strings.SplitN`, so a comment's text can hold NULs.
+func encodeTextParts(text string, encoding byte, n int) []byte {
+	var data []byte
+	for i, part := range strings.SplitN(text, "\u0000", n) {
+		if i > 0 {
+			if ((encoding == 1) || (encoding == 2)) {
+				data = append(data, 0, 0)
+			} else {
+				data = append(data, 0)
+			}
+		}
+		data = append(data, encodeStringAs(part, encoding)...)
+	}
+	return data
+}
+
+// suggestCharset guesses the charset of the texts. It returns an empty
+// string if they're ASCII, which reads the same in all of them. Text
+// that's valid UTF-8 is very likely UTF-8. Otherwise the charset whose
+// decoding looks most like words is picked, with ties going to the
+// first one tried.
+func suggestCharset(texts [][]byte) string {
+	var data []byte
+	for _, text := range texts {
+		data = append(data, text...)
+		data = append(data, ' ')
+	}
+	if !hasHighBytes(data) {
+		return ""
+	} else if utf8.Valid(data) {
+		return "utf-8"
+	}
+
+	best := "iso-8859-1"
+	best_score := 0.0
+	for _, charset := range []string{"cp1251", "cp1252", "shift-jis", "gbk"} {
+		score := scoreText(decodeCharset(data, charset))
+		if score > best_score {
+			best = charset
+			best_score = score
+		}
+	}
+
+	// CP1252 only differs from ISO-8859-1, which is read by default,
+	// in 0x80-0x9F.
+	if best == "cp1252" {
+		for _, b := range data {
+			if ((b >= 0x80) && (b <= 0x9F)) {
+				return best
+			}
+		}
+		return "iso-8859-1"
+	}
+	return best
+}
+
+// scoreText rates how much the text looks like words, from 0 to 1:
+// the share of its characters outside ASCII that are ideographs,
+// kana, CJK punctuation or letters that sit in words the way letters
+// do. Capitals start words or are in words of capitals. Letters
+// outside the Latin script aren't in words with ASCII letters, and
+// runs of three or more Latin letters outside ASCII are rare. Text
+// with bytes that aren't characters scores 0.
+func scoreText(text string) float64 {
+	runes := []rune(text)
+	isAsciiLetter := func (i int) bool {
+		return ((i >= 0) && (i < len(runes)) && (runes[i] < 0x80) && (unicode.IsLetter(runes[i])))
+	}
+	isHighLetter := func (i int) bool {
+		return ((i >= 0) && (i < len(runes)) && (runes[i] >= 0x80) && (unicode.IsLetter(runes[i])))
+	}
+
+	total, good := 0, 0
+	for i, r := range runes {
+		if r < 0x80 {
+			continue
+		}
+		total++
+		if r == utf8.RuneError {
+			return 0
+		}
+
+		// Kana and CJK punctuation, and full-width forms, but not
+		// half-width katakana, which are rare.
+		if ((unicode.Is(unicode.Han, r)) || ((r >= 0x3000) && (r <= 0x30FF)) || ((r >= 0xFF01) && (r <= 0xFF60))) {
+			good++
+		} else if ((unicode.IsLetter(r)) && (r < 0x3000)) {
+			after_letter := ((i > 0) && (unicode.IsLetter(runes[i - 1])))
+			cased := ((!unicode.IsUpper(r)) || (!after_letter) || (unicode.IsUpper(runes[i - 1])))
+			mixed := ((!unicode.Is(unicode.Latin, r)) && ((isAsciiLetter(i - 1)) || (isAsciiLetter(i + 1))))
+			run := ((unicode.Is(unicode.Latin, r)) && (((isHighLetter(i - 1)) && (isHighLetter(i + 1))) ||
+				((isHighLetter(i - 1)) && (isHighLetter(i - 2))) || ((isHighLetter(i + 1)) && (isHighLetter(i + 2)))))
+			if ((cased) && (!mixed) && (!run)) {
+				good++
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(good) / float64(total)
+}
+
+// actOnCharset prints the charset each file's encoding-0 text looks
+// to be in, or "none" if it has no such text outside ASCII. If the
+// options ask to fix the files, it instead rewrites that text as
+// Unicode, read as the charset the options or the file's directory
+// give.
+func actOnCharset(args []string, options Options) {
+	if options.FixCharset {
+		var edits []FileEdit
+		for _, arg := range args {
+			path, _ := filepath.Abs(arg)
+			charset, err := charsetForFile(path, options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			} else if charset == "" {
+				fmt.Fprintf(os.Stderr, "No charset given for '%s'. Use --charset=name or a %s file.\n", path, CHARSETFILE)
+				continue
+			}
+			edits = append(edits, FileEdit{Path: arg})
+		}
+		applyFileEdits(edits, options)
+		return
+	}
+
+	// The text is read as it is, for any charset.
+	options.Charset = "iso-8859-1"
+	for _, arg := range args {
+		item, err := itemFromFile(arg, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		charset := suggestCharset(legacyTexts(item.Tag))
+		if charset == "" {
+			fmt.Printf("%s: none\n", item.Path)
+		} else {
+			fmt.Printf("%s: %s\n", item.Path, charset)
+		}
+	}
+}
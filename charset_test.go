@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+)
+
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		charset string
+		data    string
+		want    string
+	}{
+		{"cp1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"cp1251", "\x98", "�"},
+		{"cp1252", "\x80 \x93x\x94", "€ “x”"},
+		{"shift-jis", "\x93\xfa\x96\x7b \xb1", "日本 ｱ"},
+		{"gbk", "\xd6\xd0\xce\xc4\x80", "中文€"},
+		{"utf-8", "caf\xc3\xa9 \xff", "café �"},
+		{"iso-8859-1", "caf\xe9", "café"},
+	}
+	for _, test := range tests {
+		text := decodeCharset([]byte(test.data), test.charset)
+		if text != test.want {
+			t.Errorf("%s %q: decoded as %q, want %q", test.charset, test.data, text, test.want)
+		}
+	}
+}
+
+func TestSuggestCharset(t *testing.T) {
+	tests := []struct {
+		texts []string
+		want  string
+	}{
+		{[]string{"Plain ASCII"}, ""},
+		{[]string{"Caf\xc3\xa9"}, "utf-8"},
+		{[]string{"Caf\xe9", "Se\xf1or"}, "iso-8859-1"},
+		{[]string{"Fran\xe7ois \x96 Se\xf1or \x85"}, "cp1252"},
+		{[]string{"\xcf\xf0\xe8\xe2\xe5\xf2 \xec\xe8\xf0"}, "cp1251"},
+		{[]string{"\x93\xfa\x96\x7b\x8c\xea"}, "shift-jis"},
+		{[]string{"\xd6\xd0\xce\xc4\xb8\xe8\xc7\xfa"}, "gbk"},
+	}
+	for _, test := range tests {
+		var texts [][]byte
+		for _, text := range test.texts {
+			texts = append(texts, []byte(text))
+		}
+		charset := suggestCharset(texts)
+		if charset != test.want {
+			t.Errorf("%q: suggested %q, want %q", test.texts, charset, test.want)
+		}
+	}
+}
+
+// Text and comment frames are recoded, with the comment's description
+// and text each getting a BOM. Other frames are left alone.
+func TestRecodeTag(t *testing.T) {
+	for _, version := range []int{3, 4} {
+		tag := ID3v2Tag{Header: ID3v2TagHeader{Version: version}}
+		bodies := map[string]string{
+			"TIT2": "\x00\xcf\xf0\xe8\xe2\xe5\xf2",
+			"COMM": "\x00rus\xec\xe8\xf0\x00\xcf\xf0\xe8\xe2\xe5\xf2",
+			"TALB": "\x00ASCII",
+			"WOAR": "http://example.com/\xe9",
+		}
+		for _, id := range []string{"TIT2", "COMM", "TALB", "WOAR"} {
+			tag.Frames = append(tag.Frames, ID3v2Frame{Header: ID3v2FrameHeader{Id: id}, Body: []byte(bodies[id])})
+		}
+
+		count := recodeTag(&tag, "cp1251")
+		if count != 2 {
+			t.Errorf("v2.%d: recoded %d frames, want 2", version, count)
+		}
+		if value := frameText(tag.Frames, "TIT2"); value != "Привет" {
+			t.Errorf("v2.%d: TIT2 is %q", version, value)
+		}
+		lang, description, text := parseLangText(tag.Frames[1].Body)
+		if ((lang != "rus") || (description != "мир") || (text != "Привет")) {
+			t.Errorf("v2.%d: COMM is %q %q %q", version, lang, description, text)
+		}
+		for _, n := range []int{2, 3} {
+			id := tag.Frames[n].Header.Id
+			if string(tag.Frames[n].Body) != bodies[id] {
+				t.Errorf("v2.%d: %s was changed", version, id)
+			}
+		}
+	}
+}
+
+// Each part of a user-defined text frame gets its own BOM, and of a
+// user-defined URL frame only the description is recoded.
+func TestRecodeUserDefinedFrames(t *testing.T) {
+	for _, version := range []int{3, 4} {
+		tag := ID3v2Tag{Header: ID3v2TagHeader{Version: version}}
+		for _, id := range []string{"TXXX", "WXXX"} {
+			body := "\x00d\xe9s\x00v\xe9l"
+			if id == "WXXX" {
+				body = "\x00d\xe9s\x00http://example.com/\xe9"
+			}
+			tag.Frames = append(tag.Frames, ID3v2Frame{Header: ID3v2FrameHeader{Id: id}, Body: []byte(body)})
+		}
+
+		count := recodeTag(&tag, "cp1252")
+		if count != 2 {
+			t.Errorf("v2.%d: recoded %d frames, want 2", version, count)
+		}
+		want := [][]string{{"dés", "vél"}, {"dés", "http://example.com/é"}}
+		for i, frame := range tag.Frames {
+			if values := frameValues(frame, version); !areValuesEqual(values, want[i]) {
+				t.Errorf("v2.%d: %s is %q, want %q", version, frame.Header.Id, values, want[i])
+			}
+		}
+		if version == 3 {
+			body := "\x01\xff\xfed\x00\xe9\x00s\x00\x00\x00\xff\xfev\x00\xe9\x00l\x00"
+			if string(tag.Frames[0].Body) != body {
+				t.Errorf("v2.%d: TXXX body is %q, want %q", version, tag.Frames[0].Body, body)
+			}
+		}
+	}
+}
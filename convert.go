@@ -0,0 +1,451 @@
+package main
+
+import (
+	"strings"
+)
+
+
+// convertTag returns a copy of the tag converted to the given version,
+// one version step at a time, and a list of the IDs of frames that
+// could not be converted and were dropped. The header's size fields
+// are left alone, so they still describe the tag in the file.
+func convertTag(tag ID3v2Tag, version int) (ID3v2Tag, []string) {
+	var dropped []string
+	for tag.Header.Version != version {
+		step := tag.Header.Version + 1
+		if tag.Header.Version > version {
+			step = tag.Header.Version - 1
+		}
+		var lost []string
+		tag, lost = convertTagStep(tag, step)
+		dropped = append(dropped, lost...)
+	}
+	return tag, dropped
+}
+
+// convertTagStep converts the tag to an adjacent version.
+func convertTagStep(tag ID3v2Tag, version int) (ID3v2Tag, []string) {
+	var dropped []string
+	from := tag.Header.Version
+
+	converted := ID3v2Tag{Header: tag.Header, PlainFrameSizes: tag.PlainFrameSizes}
+	converted.Header.Version = version
+	converted.Header.MinorVersion = 0
+
+	// Flags the version doesn't have are cleared. v2.3 has no footer,
+	// so the footer's bytes are counted in the size instead, to keep
+	// describing the tag in the file.
+	if ((version < 4) && (converted.Header.Footer)) {
+		converted.Header.Footer = false
+		converted.Header.Size += V2TAGHEADERSIZE
+	}
+	if version == 2 {
+		converted.Header.Extended = false
+		converted.Header.Experimental = false
+	} else {
+		converted.Header.Compression = false
+	}
+
+	add := func (id string, body []byte) {
+		header := ID3v2FrameHeader{Id: id, Size: len(body)}
+		converted.Frames = append(converted.Frames, ID3v2Frame{Header: header, Body: body})
+	}
+
+	for _, frame := range tag.Frames {
+		id := frame.Header.Id
+
+		// v2.3 spreads the recording time over three frames, v2.4
+		// keeps it in one.
+		if ((from == 3) && (version == 4)) {
+			if id == "TYER" {
+				date := v24DateFromV23(frameText(tag.Frames, "TYER"), frameText(tag.Frames, "TDAT"), frameText(tag.Frames, "TIME"))
+				add("TDRC", encodeString(date, version))
+				continue
+			} else if ((id == "TDAT") || (id == "TIME")) {
+				continue
+			}
+		} else if ((from == 4) && (version == 3) && (id == "TDRC")) {
+			year, date, time := v23DateFromV24(parseString(frame.Body))
+			for _, part := range [][2]string{{"TYER", year}, {"TDAT", date}, {"TIME", time}} {
+				if part[1] != "" {
+					add(part[0], encodeString(part[1], version))
+				}
+			}
+			continue
+		}
+
+		new_id, ok := convertFrameId(id, from, version)
+		// An encrypted frame's body can't be converted.
+		if ((!ok) || (frame.Header.Flags.Encrypted)) {
+			dropped = append(dropped, id)
+			continue
+		}
+
+		body, ok := convertFrameBody(new_id, frame.Body, from, version)
+		if !ok {
+			dropped = append(dropped, id)
+			continue
+		}
+		add(new_id, body)
+	}
+
+	return converted, dropped
+}
+
+// convertFrameId returns the frame ID that corresponds to the given
+// one in the other version, and whether that version has one. The
+// versions can be any distance apart.
+func convertFrameId(id string, from int, to int) (string, bool) {
+	for from != to {
+		step := from + 1
+		if from > to {
+			step = from - 1
+		}
+
+		var renames map[string]string
+		forward := func (part [2]string) (string, string) {
+			return part[0], part[1]
+		}
+		pull := forward
+		if step < from {
+			pull = func (part [2]string) (string, string) {
+				return part[1], part[0]
+			}
+		}
+		if ((from == 2) || (step == 2)) {
+			renames = makeV22V23FrameIdMap(pull)
+		} else {
+			renames = makeV23V24FrameIdMap(pull)
+		}
+
+		if renamed, present := renames[id]; present {
+			id = renamed
+		}
+		if _, present := makeFrameMap(step, forward)[id]; !present {
+			return id, false
+		}
+		from = step
+	}
+	return id, true
+}
+
+// convertFrameBody returns the body converted for the given frame ID
+// from the version `from` to the adjacent `version`, and whether it
+// could be converted.
+func convertFrameBody(id string, body []byte, from int, version int) ([]byte, bool) {
+	if len(body) == 0 {
+		return body, true
+	}
+
+	if ((id == "PIC") || ((id == "APIC") && (from == 2))) {
+		var ok bool
+		body, ok = convertPictureBody(body, version)
+		if !ok {
+			return nil, false
+		}
+	} else if id == "TORY" {
+		// v2.4's original release time is a timestamp, v2.3's
+		// original release year is just the year.
+		year, _, _ := v23DateFromV24(parseString(body))
+		return encodeString(year, version), true
+	}
+
+	// UTF-16BE and UTF-8 were added in v2.4.
+	if ((version < 4) && (body[0] > 1)) {
+		return reencodeFrameBody(id, body, version), true
+	}
+	return body, true
+}
+
+// reencodeFrameBody returns the body of a frame that has an encoding
+// byte with all its text in the encoding `pickEncoding` picks for the
+// version. Its other parts are kept as they are. The body of a frame
+// whose layout isn't known is returned unchanged.
+func reencodeFrameBody(id string, body []byte, version int) []byte {
+	layouts := makeFrameLayoutMap(func (part [2]string) (string, string) {
+		return part[0], part[1]
+	})
+	layout, present := layouts[id]
+	if id[0:1] == "T" {
+		layout, present = "S", true
+	}
+	if !present {
+		return body
+	}
+
+	// The body is split into parts of text and other data, so the
+	// encoding can be picked for all of the text.
+	type part struct {
+		text       bool
+		data       []byte
+		value      string
+		terminated bool
+	}
+	var parts []part
+	from := body[0]
+	rest := body[1:]
+	readText := func () {
+		end, width := findStringEnd(rest, from)
+		if end < 0 {
+			parts = append(parts, part{text: true, value: parseLangTextPart(from, rest)})
+			rest = nil
+		} else {
+			parts = append(parts, part{text: true, value: parseLangTextPart(from, rest[:end]), terminated: true})
+			rest = rest[(end + width):]
+		}
+	}
+	readData := func (size int) {
+		if size > len(rest) {
+			size = len(rest)
+		}
+		parts = append(parts, part{data: rest[:size]})
+		rest = rest[size:]
+	}
+
+	for _, step := range layout {
+		if step == 'L' {
+			readData(stringLength(rest, 0) + 1)
+		} else if ((step >= '1') && (step <= '9')) {
+			readData(int(step - '0'))
+		} else if step == 's' {
+			readText()
+		} else if step == 'S' {
+			for len(rest) > 0 {
+				readText()
+			}
+		} else if step == 'y' {
+			for len(rest) > 0 {
+				readText()
+				readData(4)
+			}
+		}
+	}
+	readData(len(rest))
+
+	var text string
+	for _, p := range parts {
+		text += p.value
+	}
+	encoding := pickEncoding(text, version)
+	terminator := []byte{0}
+	if encoding == 1 {
+		terminator = []byte{0, 0}
+	}
+
+	converted := []byte{encoding}
+	for _, p := range parts {
+		if !p.text {
+			converted = append(converted, p.data...)
+			continue
+		}
+		converted = append(converted, encodeStringAs(p.value, encoding)...)
+		if p.terminated {
+			converted = append(converted, terminator...)
+		}
+	}
+	return converted
+}
+
+// convertPictureBody converts between v2.2's PIC frame, which gives
+// the image format as three characters, and the APIC frame of later
+// versions, which gives it as a MIME type.
+func convertPictureBody(body []byte, version int) ([]byte, bool) {
+	var converted []byte
+	converted = append(converted, body[0])
+
+	if version == 2 {
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			return nil, false
+		}
+		mime := strings.ToLower(string(body[1:(end + 1)]))
+		if mime == "image/jpeg" {
+			converted = append(converted, []byte("JPG")...)
+		} else if mime == "image/png" {
+			converted = append(converted, []byte("PNG")...)
+		} else {
+			return nil, false
+		}
+		return append(converted, body[(end + 2):]...), true
+	}
+
+	if len(body) < 4 {
+		return nil, false
+	}
+	format := strings.ToLower(string(body[1:4]))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	converted = append(converted, []byte("image/" + format)...)
+	converted = append(converted, 0)
+	return append(converted, body[4:]...), true
+}
+
+// frameText returns the text of the first frame with the given ID,
+// or an empty string if there is none.
+func frameText(frames []ID3v2Frame, id string) string {
+	n := findFrame(frames, id)
+	if n < 0 {
+		return ""
+	}
+	return parseString(frames[n].Body)
+}
+
+// v24DateFromV23 combines the values of v2.3's TYER (YYYY), TDAT
+// (DDMM) and TIME (HHMM) frames into a v2.4 timestamp.
+func v24DateFromV23(year string, date string, time string) string {
+	stamp := year
+	if len(date) == 4 {
+		stamp += "-" + date[2:4] + "-" + date[0:2]
+		if len(time) == 4 {
+			stamp += "T" + time[0:2] + ":" + time[2:4]
+		}
+	}
+	return stamp
+}
+
+// v23DateFromV24 is the inverse of `v24DateFromV23`.
+func v23DateFromV24(stamp string) (string, string, string) {
+	var year, date, time string
+	if len(stamp) >= 4 {
+		year = stamp[0:4]
+	}
+	if len(stamp) >= 10 {
+		date = stamp[8:10] + stamp[5:7]
+	}
+	if len(stamp) >= 16 {
+		time = stamp[11:13] + stamp[14:16]
+	}
+	return year, date, time
+}
+
+// makeFrameMap returns the frame map for the given version.
+func makeFrameMap(version int, pull func([2]string) (string, string)) map[string]string {
+	if version == 2 {
+		return v22MakeFrameMap(pull)
+	} else if version == 3 {
+		return v23MakeFrameMap(pull)
+	} else if version == 4 {
+		return v24MakeFrameMap(pull)
+	}
+	return make(map[string]string)
+}
+
+// v2.2 frame IDs and their v2.3 equivalents. Frames whose bodies
+// differ between the versions, other than PIC, are left out.
+func makeV22V23FrameIdMap(pull func([2]string) (string, string)) map[string]string {
+	parts := [...][2]string{
+		[2]string{"BUF", "RBUF"},
+		[2]string{"CNT", "PCNT"},
+		[2]string{"COM", "COMM"},
+		[2]string{"CRA", "AENC"},
+		[2]string{"ETC", "ETCO"},
+		[2]string{"EQU", "EQUA"},
+		[2]string{"GEO", "GEOB"},
+		[2]string{"IPL", "IPLS"},
+		[2]string{"MCI", "MCDI"},
+		[2]string{"MLL", "MLLT"},
+		[2]string{"PIC", "APIC"},
+		[2]string{"POP", "POPM"},
+		[2]string{"REV", "RVRB"},
+		[2]string{"RVA", "RVAD"},
+		[2]string{"SLT", "SYLT"},
+		[2]string{"STC", "SYTC"},
+		[2]string{"TAL", "TALB"},
+		[2]string{"TBP", "TBPM"},
+		[2]string{"TCM", "TCOM"},
+		[2]string{"TCO", "TCON"},
+		[2]string{"TCR", "TCOP"},
+		[2]string{"TDA", "TDAT"},
+		[2]string{"TDY", "TDLY"},
+		[2]string{"TEN", "TENC"},
+		[2]string{"TFT", "TFLT"},
+		[2]string{"TIM", "TIME"},
+		[2]string{"TKE", "TKEY"},
+		[2]string{"TLA", "TLAN"},
+		[2]string{"TLE", "TLEN"},
+		[2]string{"TMT", "TMED"},
+		[2]string{"TOA", "TOPE"},
+		[2]string{"TOF", "TOFN"},
+		[2]string{"TOL", "TOLY"},
+		[2]string{"TOR", "TORY"},
+		[2]string{"TOT", "TOAL"},
+		[2]string{"TP1", "TPE1"},
+		[2]string{"TP2", "TPE2"},
+		[2]string{"TP3", "TPE3"},
+		[2]string{"TP4", "TPE4"},
+		[2]string{"TPA", "TPOS"},
+		[2]string{"TPB", "TPUB"},
+		[2]string{"TRC", "TSRC"},
+		[2]string{"TRD", "TRDA"},
+		[2]string{"TRK", "TRCK"},
+		[2]string{"TSI", "TSIZ"},
+		[2]string{"TSS", "TSSE"},
+		[2]string{"TT1", "TIT1"},
+		[2]string{"TT2", "TIT2"},
+		[2]string{"TT3", "TIT3"},
+		[2]string{"TXT", "TEXT"},
+		[2]string{"TXX", "TXXX"},
+		[2]string{"TYE", "TYER"},
+		[2]string{"UFI", "UFID"},
+		[2]string{"ULT", "USLT"},
+		[2]string{"WAF", "WOAF"},
+		[2]string{"WAR", "WOAR"},
+		[2]string{"WAS", "WOAS"},
+		[2]string{"WCM", "WCOM"},
+		[2]string{"WCP", "WCOP"},
+		[2]string{"WPB", "WPUB"},
+		[2]string{"WXX", "WXXX"},
+	}
+
+	return makeMap(parts[:], pull)
+}
+
+// v2.3 frame IDs that were renamed in v2.4. Frames with the same ID
+// in both versions aren't listed. The bodies of the date frames are
+// converted by `convertTagStep`.
+func makeV23V24FrameIdMap(pull func([2]string) (string, string)) map[string]string {
+	parts := [...][2]string{
+		[2]string{"IPLS", "TIPL"},
+		[2]string{"TORY", "TDOR"},
+		[2]string{"TYER", "TDRC"},
+	}
+
+	return makeMap(parts[:], pull)
+}
+
+// The layout of the body of each frame with an encoding byte, after
+// that byte, one letter a part:
+// L: an ISO-8859-1 string and its terminator
+// 1-9: that many bytes of other data
+// s: a string in the frame's encoding and its terminator
+// S: strings in the frame's encoding, up to the end of the body
+// y: strings in the frame's encoding, each followed by a four-byte
+//    timestamp, up to the end of the body
+// Whatever is left after the parts is binary data, like a URL or an
+// image. Text frames, which aren't listed, are all "S".
+func makeFrameLayoutMap(pull func([2]string) (string, string)) map[string]string {
+	parts := [...][2]string{
+		[2]string{"APIC", "L1s"},
+		[2]string{"COMM", "3S"},
+		[2]string{"COMR", "L8L1ss"},
+		[2]string{"GEOB", "Lss"},
+		[2]string{"IPLS", "S"},
+		[2]string{"OWNE", "L8S"},
+		[2]string{"SYLT", "5sy"},
+		[2]string{"USER", "3S"},
+		[2]string{"USLT", "3S"},
+		[2]string{"WXXX", "s"},
+
+		// v2.2 frames.
+		[2]string{"COM", "3S"},
+		[2]string{"GEO", "Lss"},
+		[2]string{"IPL", "S"},
+		[2]string{"PIC", "4s"},
+		[2]string{"SLT", "5sy"},
+		[2]string{"ULT", "3S"},
+		[2]string{"WXX", "s"},
+	}
+
+	return makeMap(parts[:], pull)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+
+func TestConvertTag(t *testing.T) {
+	jpeg := "\xff\xd8\xff\xe0"
+	tests := []struct {
+		name   string
+		from   int
+		to     int
+		frames [][2]string
+		want   [][2]string
+	}{
+		{"date v2.3 to v2.4", 3, 4,
+			[][2]string{{"TYER", "\x002006"}, {"TDAT", "\x000405"}, {"TIME", "\x000302"}},
+			[][2]string{{"TDRC", "\x002006-05-04T03:02"}}},
+		{"date v2.4 to v2.3", 4, 3,
+			[][2]string{{"TDRC", "\x002006-05-04T03:02"}},
+			[][2]string{{"TYER", "\x002006"}, {"TDAT", "\x000405"}, {"TIME", "\x000302"}}},
+		{"UTF-8 to UTF-16", 4, 3,
+			[][2]string{{"TIT2", "\x03Ω\x00A"}},
+			[][2]string{{"TIT2", "\x01\xff\xfe\xa9\x03\x00\x00\xff\xfeA\x00"}}},
+		{"UTF-8 Latin-1 text", 4, 3,
+			[][2]string{{"TIT2", "\x03café"}},
+			[][2]string{{"TIT2", "\x00caf\xe9"}}},
+		{"comment", 4, 3,
+			[][2]string{{"COMM", "\x03engΩ\x00Text"}},
+			[][2]string{{"COMM", "\x01eng\xff\xfe\xa9\x03\x00\x00\xff\xfeT\x00e\x00x\x00t\x00"}}},
+		{"picture v2.4 to v2.3", 4, 3,
+			[][2]string{{"APIC", "\x03image/jpeg\x00\x03Ω\x00" + jpeg}},
+			[][2]string{{"APIC", "\x01image/jpeg\x00\x03\xff\xfe\xa9\x03\x00\x00" + jpeg}}},
+		{"picture v2.3 to v2.2", 3, 2,
+			[][2]string{{"APIC", "\x00image/jpeg\x00\x03\x00" + jpeg}, {"TIT2", "\x00Title"}},
+			[][2]string{{"PIC", "\x00JPG\x03\x00" + jpeg}, {"TT2", "\x00Title"}}},
+		{"picture v2.2 to v2.4", 2, 4,
+			[][2]string{{"PIC", "\x00PNG\x03\x00" + jpeg}, {"COM", "\x00eng\x00Text"}},
+			[][2]string{{"APIC", "\x00image/png\x00\x03\x00" + jpeg}, {"COMM", "\x00eng\x00Text"}}},
+		{"dropped", 4, 2,
+			[][2]string{{"TIT2", "\x00Title"}, {"TDRL", "\x002006"}},
+			[][2]string{{"TT2", "\x00Title"}}},
+	}
+
+	for _, test := range tests {
+		tag := ID3v2Tag{Header: ID3v2TagHeader{Version: test.from}}
+		for _, frame := range test.frames {
+			tag.Frames = append(tag.Frames, ID3v2Frame{Header: ID3v2FrameHeader{Id: frame[0]}, Body: []byte(frame[1])})
+		}
+
+		converted, _ := convertTag(tag, test.to)
+		if converted.Header.Version != test.to {
+			t.Errorf("%s: converted to v2.%d", test.name, converted.Header.Version)
+		}
+		if len(converted.Frames) != len(test.want) {
+			t.Errorf("%s: converted to %d frames, want %d", test.name, len(converted.Frames), len(test.want))
+			continue
+		}
+		for i, frame := range converted.Frames {
+			if ((frame.Header.Id != test.want[i][0]) || (!bytes.Equal(frame.Body, []byte(test.want[i][1])))) {
+				t.Errorf("%s: frame %d is %s %q, want %s %q", test.name, i, frame.Header.Id, frame.Body, test.want[i][0], test.want[i][1])
+			}
+		}
+	}
+}
+
+// Converting down clears the header flags the version doesn't have,
+// but the header still describes the tag in the file.
+func TestConvertTagHeader(t *testing.T) {
+	header := ID3v2TagHeader{Version: 4, Size: 100, Footer: true, Extended: true, Experimental: true, Unsynchronization: true}
+	tests := []struct {
+		version int
+		want    ID3v2TagHeader
+	}{
+		{3, ID3v2TagHeader{Version: 3, Size: 110, Extended: true, Experimental: true, Unsynchronization: true}},
+		{2, ID3v2TagHeader{Version: 2, Size: 110, Unsynchronization: true}},
+	}
+	for _, test := range tests {
+		converted, _ := convertTag(ID3v2Tag{Header: header}, test.version)
+		if converted.Header != test.want {
+			t.Errorf("v2.%d: header is %+v, want %+v", test.version, converted.Header, test.want)
+		}
+		if tagFileSize(converted.Header) != tagFileSize(header) {
+			t.Errorf("v2.%d: the tag takes %d bytes, want %d", test.version, tagFileSize(converted.Header), tagFileSize(header))
+		}
+	}
+}
+
+// A v2.4 tag with a footer converted to v2.3 is written in place, in
+// the space of the tag and its footer.
+func TestConvertTagWithFooterInPlace(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	tag := ID3v2Tag{Header: ID3v2TagHeader{Version: 4, Footer: true}, Frames: makeTestFrames(4)}
+	data, err := makeTagBytes(tag, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, append(data, testAudio...))
+
+	items, _ := planDocument(t, []byte("[3:" + path + "]\n"), Options{ })
+	written, in_place, err := makeItemTagBytes(items[0])
+	if ((err != nil) || (!in_place) || (len(written) != len(data))) {
+		t.Fatalf("the tag isn't written in place (%d bytes, %v)", len(written), err)
+	}
+	journal, err := openJournal("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeItem(items[0], journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := checkTestFile(t, "v2.3", path, makeTestFrames(3))
+	if ((item.Tag.Header.Version != 3) || (tagFileSize(item.Tag.Header) != len(data))) {
+		t.Errorf("the file's tag is v2.%d, %d bytes", item.Tag.Header.Version, tagFileSize(item.Tag.Header))
+	}
+}
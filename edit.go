@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+
+// readFileEdits reads an edit document from the lexer. The document
+// looks like the program's output: a file path in brackets followed
+// by the `frame name: frame data` lines to set in that file's tag.
+// A `-frame name` line removes every frame of that type from the tag,
+// and a `-*` line removes every frame not given a value.
+func readFileEdits(lexer *Lexer) ([]FileEdit, error) {
+	var edits []FileEdit
+	var key string
+	var version int
+
+	for lexer.More() {
+		token, err := lexer.Next()
+		if errors.Is(err, ErrLexerSyntax) {
+			return edits, err
+		} else if ((err != nil) && (err != io.EOF)) {
+			return edits, errors.New(fmt.Sprintf("Error getting lexer's next token: %s", err))
+		}
+
+		switch token.Type {
+		case TokenFileVersion:
+			version, err = strconv.Atoi(token.Value)
+			if ((err != nil) || (version < 2) || (version > 4)) {
+				return edits, syntaxError("unrecognized tag version '%s'", token.Value)
+			}
+		case TokenFilePath:
+			edits = append(edits, FileEdit{Path: token.Value, Version: version})
+			version = 0
+		case TokenFieldKey:
+			key = strings.TrimSpace(token.Value)
+		case TokenFieldValue:
+			if len(edits) == 0 {
+				return edits, syntaxError("field '%s' is not preceded by a file path", key)
+			}
+			field := FieldEdit{Key: key, Value: token.Value}
+			edits[len(edits) - 1].Fields = append(edits[len(edits) - 1].Fields, field)
+		case TokenFieldDelete:
+			name := strings.TrimSpace(token.Value)
+			if len(edits) == 0 {
+				return edits, syntaxError("deletion of '%s' is not preceded by a file path", name)
+			}
+			if name == "*" {
+				edits[len(edits) - 1].Prune = true
+			} else {
+				edits[len(edits) - 1].Deletes = append(edits[len(edits) - 1].Deletes, name)
+			}
+		case TokenUnknown:
+			if token.Value != "" {
+				return edits, syntaxError("unrecognized line '%s'", token.Value)
+			}
+		}
+	}
+
+	return edits, lexer.Err
+}
+
+// applyFileEdit reads the tag of the edit's file, applies the edit's
+// fields to it, and writes the result back to the file if anything
+// changed.
+func applyFileEdit(edit FileEdit, journal *Journal, options Options) ([]FrameChange, error) {
+	item, changes, err := planFileEdit(edit, options)
+	if ((err != nil) || (item == nil)) {
+		return changes, err
+	}
+	return changes, writeItem(item, journal)
+}
+
+// previewFileEdit prints the changes the edit would make to its file's
+// tag, like a unified diff, and how the tag would be written. Nothing
+// is written.
+func previewFileEdit(edit FileEdit, options Options) error {
+	item, changes, err := planFileEdit(edit, options)
+	if err != nil {
+		return err
+	}
+
+	path, _ := filepath.Abs(edit.Path)
+	fmt.Printf("--- %s\n", path)
+	fmt.Printf("+++ %s\n", path)
+	if item == nil {
+		fmt.Println("# No changes.")
+		return nil
+	}
+
+	names := makeFrameMap(item.Tag.Header.Version, func (part [2]string) (string, string) {
+		return part[0], part[1]
+	})
+	name := func (id string) string {
+		if name, present := names[id]; present {
+			return name
+		}
+		return id
+	}
+
+	if item.Converted {
+		fmt.Printf("# Convert to ID3v2.%d.\n", item.Tag.Header.Version)
+	}
+	if item.Tag.PlainFrameSizes {
+		fmt.Println("# Fix frame sizes that aren't synchsafe.")
+	}
+	if item.Recoded > 0 {
+		fmt.Printf("# Store the text of %d frames as Unicode.\n", item.Recoded)
+	}
+	for _, change := range changes {
+		if ((change.Type == FrameRemoved) || (change.Type == FrameChanged)) {
+			for _, value := range change.Old {
+				fmt.Printf("-%s: %s\n", name(change.Id), formatFieldValue(value))
+			}
+		}
+		if ((change.Type == FrameAdded) || (change.Type == FrameChanged)) {
+			for _, value := range change.New {
+				fmt.Printf("+%s: %s\n", name(change.Id), formatFieldValue(value))
+			}
+		}
+	}
+
+	_, in_place, err := makeItemTagBytes(item)
+	if err != nil {
+		return err
+	}
+	if in_place {
+		fmt.Println("# The tag would be written in place.")
+	} else {
+		fmt.Println("# The file would be rewritten.")
+	}
+	return nil
+}
+
+// planFileEdit reads the tag of the edit's file and returns the item
+// with the edit applied to its tag, along with the changes made. If
+// the edit wouldn't change the file, the item is nil.
+func planFileEdit(edit FileEdit, options Options) (*Item, []FrameChange, error) {
+	// Tags are read strictly for editing, so a corrupt tag isn't
+	// written back without the frames that couldn't be read.
+	options.Tolerant = false
+	item, err := itemFromFile(edit.Path, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = checkItemEditable(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	if options.Unsync {
+		item.Tag.Header.Unsynchronization = true
+	}
+
+	if ((edit.Version != 0) && (edit.Version != item.Tag.Header.Version)) {
+		item, err = convertItem(item, edit.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	frames, changes, err := diffItem(item, edit, options)
+	// A tag with plain frame sizes, or with text read as a charset
+	// that's to be fixed, is written even if nothing else changes, to
+	// fix it.
+	fix_charset := ((options.FixCharset) && (item.Recoded > 0))
+	if ((err != nil) || ((len(changes) == 0) && (!item.Converted) && (!item.Tag.PlainFrameSizes) && (!fix_charset))) {
+		return nil, changes, err
+	}
+
+	frames, discarded := discardOnTagAlter(frames, edit, item.Tag.Header.Version)
+	item.Tag.Frames = frames
+	if options.Compress {
+		markFramesForCompression(&item.Tag)
+	}
+	return item, append(changes, discarded...), nil
+}
+
+// checkItemEditable returns an error if the item's tag can't be
+// written. The writer only writes a tag at the start of the file,
+// which the appended tags would still be merged over.
+func checkItemEditable(item *Item) error {
+	if ((len(item.Tags) > 1) || (item.Tag.Offset != 0)) {
+		return errors.New(fmt.Sprintf("Can't edit '%s': tags appended to the file can't be written yet.", item.Path))
+	}
+	return nil
+}
+
+// discardOnTagAlter removes the frames that ask to be discarded when
+// the tag is changed, unless the edit gives them a value.
+func discardOnTagAlter(frames []ID3v2Frame, edit FileEdit, version int) ([]ID3v2Frame, []FrameChange) {
+	var changes []FrameChange
+
+	given := make(map[string]bool)
+	for _, field := range edit.Fields {
+		id, _ := findFrameId(field.Key, version)
+		given[id] = true
+	}
+
+	var kept []ID3v2Frame
+	for _, frame := range frames {
+		if ((frame.Header.Flags.DiscardOnTagAlter) && (!given[frame.Header.Id])) {
+			changes = append(changes, FrameChange{Type: FrameRemoved, Id: frame.Header.Id, Old: describeFrameBody(frame, version)})
+		} else {
+			kept = append(kept, frame)
+		}
+	}
+	return kept, changes
+}
+
+// diffItem compares the edit's fields with the item's frames. It
+// returns the frames the item's tag would have after the edit and
+// the list of changes that would make it so. The item's frames are
+// not modified. Frames marked read-only can't be changed or removed
+// unless the options force it.
+func diffItem(item *Item, edit FileEdit, options Options) ([]ID3v2Frame, []FrameChange, error) {
+	var changes []FrameChange
+	read_only := func (id string) error {
+		return errors.New(fmt.Sprintf("Frame %s in '%s' is read-only. Use --force to change it.", id, item.Path))
+	}
+
+	version := item.Tag.Header.Version
+
+	// Deletions are made first, so a document can remove all the
+	// frames of a type and then give the ones it wants.
+	deleted := make(map[string]bool)
+	for _, name := range edit.Deletes {
+		id, present := findFrameId(name, version)
+		if !present {
+			return nil, nil, errors.New(fmt.Sprintf("Unrecognized frame name '%s' for ID3v2.%d tag in '%s'.", name, version, item.Path))
+		}
+		deleted[id] = true
+	}
+	kept := make(map[string]bool)
+	for _, field := range edit.Fields {
+		id, present := findFrameId(field.Key, version)
+		if !present {
+			return nil, nil, errors.New(fmt.Sprintf("Unrecognized frame name '%s' for ID3v2.%d tag in '%s'.", field.Key, version, item.Path))
+		}
+		kept[id] = true
+	}
+
+	var frames []ID3v2Frame
+	for _, frame := range item.Tag.Frames {
+		id := frame.Header.Id
+		if ((deleted[id]) || ((edit.Prune) && (!kept[id]))) {
+			if ((frame.Header.Flags.ReadOnly) && (!options.Force)) {
+				return nil, nil, read_only(id)
+			}
+			changes = append(changes, FrameChange{Type: FrameRemoved, Id: id, Old: describeFrameBody(frame, version)})
+		} else {
+			frames = append(frames, frame)
+		}
+	}
+
+	// Each field gives a value, and a frame given more than one
+	// holds them all, in order.
+	var ids []string
+	lines := make(map[string][]string)
+	for _, field := range edit.Fields {
+		id, _ := findFrameId(field.Key, version)
+		if _, present := lines[id]; !present {
+			ids = append(ids, id)
+		}
+		lines[id] = append(lines[id], field.Value)
+	}
+
+	// The frames given lines, by index.
+	given := make(map[int]bool)
+	set := func (n int, id string, values []string) error {
+		body, err := makeFrameBody(id, values, version, options.V23Separator)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Can't set '%s' in '%s' (%s).", id, item.Path, err))
+		}
+		if n < 0 {
+			frame := ID3v2Frame{Header: ID3v2FrameHeader{Id: id, Size: len(body)}, Body: body}
+			frames = append(frames, frame)
+			given[len(frames) - 1] = true
+			changes = append(changes, FrameChange{Type: FrameAdded, Id: id, New: values})
+			return nil
+		}
+
+		given[n] = true
+		old := frameValues(frames[n], version)
+		if areValuesEqual(old, values) {
+			return nil
+		}
+		flags := frames[n].Header.Flags
+		if ((flags.ReadOnly) && (!options.Force)) {
+			return read_only(id)
+		}
+		if ((isLangTextFrame(id)) && (len(frames[n].Body) >= 4)) {
+			// Keep the frame's language. One too short to have a
+			// language gets the default.
+			copy(body[1:4], frames[n].Body[1:4])
+		}
+		// A frame that couldn't be decrypted can't be encrypted
+		// again, so its new body is stored plainly.
+		if !isFrameReadable(frames[n]) {
+			frames[n].Header.Flags.Encrypted = false
+		}
+		frames[n].Body = body
+		frames[n].Header.Size = len(body)
+		changes = append(changes, FrameChange{Type: FrameChanged, Id: id, Old: old, New: values})
+		return nil
+	}
+
+	// A tag can have several frames with an ID, like a TXXX frame for
+	// each description, or duplicates some writers leave. The lines
+	// are given to those frames in the order they were printed, each
+	// taking as many lines as it printed and the last one the rest.
+	// Frames left without lines aren't changed, unless the document
+	// is complete.
+	for _, id := range ids {
+		rest := lines[id]
+		targets := findEditableFrames(frames, id)
+		if len(targets) == 0 {
+			targets = []int{-1}
+		}
+		for i, n := range targets {
+			count := len(rest)
+			if ((i < len(targets) - 1) && (countFrameLines(frames[n], version, options.Separator) < count)) {
+				count = countFrameLines(frames[n], version, options.Separator)
+			}
+			if count == 0 {
+				break
+			}
+
+			var values []string
+			for _, line := range rest[:count] {
+				if options.Separator != "" {
+					values = append(values, strings.Split(line, options.Separator)...)
+				} else {
+					values = append(values, line)
+				}
+			}
+			rest = rest[count:]
+
+			err := set(n, id, values)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// A complete document gives every frame it would print, so those
+	// it doesn't give a line were removed from it.
+	if edit.Complete {
+		var kept []ID3v2Frame
+		for n, frame := range frames {
+			if ((given[n]) || (!isFramePrinted(frame, version))) {
+				kept = append(kept, frame)
+				continue
+			}
+			if ((frame.Header.Flags.ReadOnly) && (!options.Force)) {
+				return nil, nil, read_only(frame.Header.Id)
+			}
+			changes = append(changes, FrameChange{Type: FrameRemoved, Id: frame.Header.Id, Old: describeFrameBody(frame, version)})
+		}
+		frames = kept
+	}
+
+	return frames, changes, nil
+}
+
+// isFramePrinted checks whether `printItemData` prints the frame, and
+// so whether an edit document can give it.
+func isFramePrinted(frame ID3v2Frame, version int) bool {
+	keys := makeFrameMap(version, func (part [2]string) (string, string) {
+		return part[0], part[1]
+	})
+	if version == 2 {
+		return v22IsFrameEditable(keys, frame)
+	} else if version == 3 {
+		return v23IsFrameEditable(keys, frame)
+	}
+	return v24IsFrameEditable(keys, frame)
+}
+
+// convertItem returns a copy of the item with its tag converted to
+// the given version. Frames that can't be converted are dropped, and
+// a notice is printed for each.
+func convertItem(item *Item, version int) (*Item, error) {
+	converted, err := makeItem(version, item.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, dropped := convertTag(item.Tag, version)
+	for _, id := range dropped {
+		fmt.Fprintf(os.Stderr, "Dropping frame %s from '%s': it can't be converted to ID3v2.%d.\n", id, item.Path, version)
+	}
+	converted.Tag = tag
+	converted.Converted = true
+
+	return converted, nil
+}
+
+// findFrame returns the index of the first frame with the given ID,
+// or -1 if there is none.
+func findFrame(frames []ID3v2Frame, id string) int {
+	for i, frame := range frames {
+		if frame.Header.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findEditableFrames returns the indexes of the frames with the given
+// ID that are printed to be edited, in order. Comment and lyrics
+// frames that have a description aren't, and neither are frames that
+// couldn't be decrypted, unless one of those is the only frame with
+// the ID, in which case it can be overwritten.
+func findEditableFrames(frames []ID3v2Frame, id string) []int {
+	var found []int
+	fallback := -1
+	for i, frame := range frames {
+		if ((frame.Header.Id != id) || ((isLangTextFrame(id)) && (!isMainLangTextFrame(frame)))) {
+			continue
+		}
+		if isFrameReadable(frame) {
+			found = append(found, i)
+		} else if fallback < 0 {
+			fallback = i
+		}
+	}
+	if ((len(found) == 0) && (fallback >= 0)) {
+		found = append(found, fallback)
+	}
+	return found
+}
+
+// countFrameLines returns how many lines `printFrameValues` prints for
+// the frame.
+func countFrameLines(frame ID3v2Frame, version int, separator string) int {
+	if separator != "" {
+		return 1
+	}
+	return len(frameValues(frame, version))
+}
+
+func areValuesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeFrameBody returns the frame's values as text if it's a
+// text, URL, comment or lyrics frame, or a note of its size if not.
+func describeFrameBody(frame ID3v2Frame, version int) []string {
+	id := frame.Header.Id
+	if (((id[0:1] == "T") || (id[0:1] == "W") || (isLangTextFrame(id))) && (len(frame.Body) > 0)) {
+		return frameValues(frame, version)
+	}
+	return []string{fmt.Sprintf("<%d bytes>", len(frame.Body))}
+}
+
+// makeFrameBody returns the body for a frame with the given ID and
+// values. URL frames contain only the ISO-8859-1 URL. Comment and
+// lyrics frames are given an English language code and no
+// description. User-defined frames take their description from the
+// first value. All other frames start with an encoding byte. Only
+// text frames can have more than one value, which are joined as
+// `joinFrameValues` says.
+func makeFrameBody(id string, values []string, version int, separator string) ([]byte, error) {
+	if separator == "" {
+		separator = "/"
+	}
+
+	if isUserDefinedFrame(id) {
+		if len(values) < 2 {
+			return nil, errors.New("user-defined frames need a description and a value")
+		} else if ((len(values) > 2) && (id[0:1] != "T")) {
+			return nil, errors.New("only text frames can have more than one value")
+		}
+		return makeUserDefinedBody(id, values[0], joinFrameValues(id, values[1:], version, separator), version)
+	} else if ((len(values) > 1) && (id[0:1] != "T")) {
+		return nil, errors.New("only text frames can have more than one value")
+	}
+	value := joinFrameValues(id, values, version, separator)
+
+	if isLangTextFrame(id) {
+		return makeLangTextBody("eng", "", value, version), nil
+	} else if ((id[0:1] == "W") && (id != "WXX") && (id != "WXXX")) {
+		latin, ok := UTF8ToISO8859_1(value)
+		if !ok {
+			return nil, errors.New("URLs must be ISO-8859-1 text")
+		}
+		return latin, nil
+	}
+	return encodeString(value, version), nil
+}
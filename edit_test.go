@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+
+// copyTestFile copies the file to a temporary directory and returns the
+// copy's path.
+func copyTestFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, data)
+}
+
+// planDocument parses the edit document and plans each of its edits.
+func planDocument(t *testing.T, doc []byte, options Options) ([]*Item, [][]FrameChange) {
+	lexer := newLexer(bufio.NewReader(bytes.NewReader(doc)))
+	edits, err := readFileEdits(&lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []*Item
+	var changes [][]FrameChange
+	for _, edit := range edits {
+		item, each, err := planFileEdit(edit, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+		changes = append(changes, each)
+	}
+	return items, changes
+}
+
+// The program's output, fed back to it, changes nothing. The
+// ISO-8859-1 file has two TYER frames.
+func TestRoundTripChangesNothing(t *testing.T) {
+	paths, _ := filepath.Glob("mp3/*.mp3")
+	if len(paths) == 0 {
+		t.Fatal("no test files in mp3/")
+	}
+	for _, separator := range []string{"", " | "} {
+		for _, path := range paths {
+			options := Options{Separator: separator}
+			item, err := itemFromFile(copyTestFile(t, path), options)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			var doc bytes.Buffer
+			printItemData(&doc, item, separator)
+
+			items, changes := planDocument(t, doc.Bytes(), options)
+			if ((len(items) != 1) || (items[0] != nil) || (len(changes[0]) != 0)) {
+				t.Errorf("%s, separator %q: the round trip changes %v", path, separator, changes)
+			}
+		}
+	}
+}
+
+// Repeated lines go to the frames with the ID in order.
+func TestEditDuplicateFrames(t *testing.T) {
+	data := makeTestTag(3,
+		makeTestFrame(3, "TYER", nil, []byte("\x002006")),
+		makeTestFrame(3, "TIT2", nil, []byte("\x00Title")),
+		makeTestFrame(3, "TYER", nil, []byte("\x002006")))
+	path := writeTestFile(t, data)
+
+	doc := "[" + path + "]\nYear: 2006\nYear: 2007\n"
+	items, changes := planDocument(t, []byte(doc), Options{ })
+	if ((items[0] == nil) || (len(changes[0]) != 1)) {
+		t.Fatalf("changes are %v, want one", changes)
+	}
+	var years []string
+	for _, frame := range items[0].Tag.Frames {
+		if frame.Header.Id == "TYER" {
+			years = append(years, frameValue(frame))
+		}
+	}
+	if !areValuesEqual(years, []string{"2006", "2007"}) {
+		t.Errorf("years are %v, want [2006 2007]", years)
+	}
+}
+
+// A comment keeps its language when it's changed, and one too short
+// to have a language gets the default.
+func TestEditCommentLanguage(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"\x00fra\x00Comment", "\x00fra\x00New"},
+		{"\x00e", "\x00eng\x00New"},
+		{"", "\x00eng\x00New"},
+	}
+	for _, test := range tests {
+		path := writeTestFile(t, makeTestTag(3, makeTestFrame(3, "COMM", nil, []byte(test.body))))
+		items, _ := planDocument(t, []byte("[" + path + "]\nComment: New\n"), Options{ })
+		if items[0] == nil {
+			t.Errorf("%q: the comment wasn't changed", test.body)
+			continue
+		}
+		if body := string(items[0].Tag.Frames[0].Body); body != test.want {
+			t.Errorf("%q: body is %q, want %q", test.body, body, test.want)
+		}
+	}
+}
+
+// The first value of a user-defined frame is its description, and
+// the body reads back as the values it was made from.
+func TestMakeUserDefinedFrameBody(t *testing.T) {
+	tests := []struct {
+		id      string
+		values  []string
+		version int
+		want    []byte
+	}{
+		{"TXXX", []string{"desc", "value"}, 3, []byte("\x00desc\x00value")},
+		{"TXXX", []string{"", "value"}, 4, []byte("\x00\x00value")},
+		{"TXXX", []string{"desc", "a", "b"}, 4, []byte("\x00desc\x00a\x00b")},
+		{"TXXX", []string{"d", "Ω"}, 3, []byte("\x01\xff\xfed\x00\x00\x00\xff\xfe\xa9\x03")},
+		{"WXXX", []string{"home", "http://example.com/"}, 3, []byte("\x00home\x00http://example.com/")},
+		{"WXXX", []string{"Ω", "http://example.com/"}, 4, []byte("\x03Ω\x00http://example.com/")},
+		{"WXX", []string{"", "http://example.com/"}, 2, []byte("\x00\x00http://example.com/")},
+	}
+	for _, test := range tests {
+		body, err := makeFrameBody(test.id, test.values, test.version, "")
+		if err != nil {
+			t.Errorf("%s %q: %v", test.id, test.values, err)
+			continue
+		}
+		if !bytes.Equal(body, test.want) {
+			t.Errorf("%s %q: body is %q, want %q", test.id, test.values, body, test.want)
+		}
+		frame := ID3v2Frame{Header: ID3v2FrameHeader{Id: test.id}, Body: body}
+		if values := frameValues(frame, test.version); !areValuesEqual(values, test.values) {
+			t.Errorf("%s %q: read back as %q", test.id, test.values, values)
+		}
+	}
+
+	for _, values := range [][]string{{"only"}, {"d", "http://a/", "http://b/"}} {
+		_, err := makeFrameBody("WXXX", values, 3, "")
+		if err == nil {
+			t.Errorf("WXXX %q: no error", values)
+		}
+	}
+}
+
+// A deletion line removes every frame with the ID, and "-*" removes
+// the frames the document doesn't give.
+func TestEditDeletes(t *testing.T) {
+	data := makeTestTag(3,
+		makeTestFrame(3, "TYER", nil, []byte("\x002006")),
+		makeTestFrame(3, "TIT2", nil, []byte("\x00Title")),
+		makeTestFrame(3, "TALB", nil, []byte("\x00Album")),
+		makeTestFrame(3, "TYER", nil, []byte("\x002007")))
+	path := writeTestFile(t, data)
+
+	tests := []struct {
+		doc  string
+		want []string
+	}{
+		{"-Year\n", []string{"TIT2", "TALB"}},
+		{"-*\nTitle: Title\n", []string{"TIT2"}},
+	}
+	for _, test := range tests {
+		items, _ := planDocument(t, []byte("[" + path + "]\n" + test.doc), Options{ })
+		var ids []string
+		for _, frame := range items[0].Tag.Frames {
+			ids = append(ids, frame.Header.Id)
+		}
+		if !areValuesEqual(ids, test.want) {
+			t.Errorf("%q: frames are %v, want %v", test.doc, ids, test.want)
+		}
+	}
+}
+
+// In the editor, a printed line that's removed removes its frame, but
+// frames the editor doesn't print are kept. Elsewhere, frames without
+// lines are left alone.
+func TestEditorDeletes(t *testing.T) {
+	data := makeTestTag(3,
+		makeTestFrame(3, "TYER", nil, []byte("\x002006")),
+		makeTestFrame(3, "TIT2", nil, []byte("\x00Title")),
+		makeTestFrame(3, "TALB", nil, []byte("\x00Album")),
+		makeTestFrame(3, "PRIV", nil, []byte("owner\x00data")),
+		makeTestFrame(3, "TYER", nil, []byte("\x002007")))
+	path := writeTestFile(t, data)
+
+	tests := []struct {
+		doc     string
+		printed bool
+		want    []string
+	}{
+		{"Year: 2006\nTitle: Title\nYear: 2007\n", true, []string{"TYER", "TIT2", "PRIV", "TYER"}},
+		{"Year: 2006\nTitle: Title\nAlbum: Album\n", true, []string{"TYER", "TIT2", "TALB", "PRIV"}},
+		{"Year: 2006\nTitle: Title\n", false, []string{"TYER", "TIT2", "TALB", "PRIV", "TYER"}},
+	}
+	for _, test := range tests {
+		doc := "[" + path + "]\n" + test.doc
+		edits, problems := checkEditDocument([]byte(doc), map[string]bool{path: test.printed}, Options{ })
+		if len(problems) != 0 {
+			t.Fatalf("%q: %v", test.doc, problems)
+		}
+		item, _, err := planFileEdit(edits[0], Options{ })
+		if ((err == nil) && (item == nil)) {
+			item, err = itemFromFile(path, Options{ })
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.doc, err)
+		}
+		var ids []string
+		for _, frame := range item.Tag.Frames {
+			ids = append(ids, frame.Header.Id)
+		}
+		if !areValuesEqual(ids, test.want) {
+			t.Errorf("%q: frames are %v, want %v", test.doc, ids, test.want)
+		}
+	}
+}
+
+// captureStdout returns what the function prints to stdout.
+func captureStdout(t *testing.T, f func ()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func () {
+		os.Stdout = stdout
+	}()
+
+	f()
+	writer.Close()
+	out, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// A preview shows the changes as a diff and leaves the file alone.
+func TestPreviewFileEdit(t *testing.T) {
+	data := makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Title")))
+	path := writeTestFile(t, data)
+	edit := FileEdit{Path: path, Fields: []FieldEdit{{Key: "Title", Value: "New"}}}
+
+	var err error
+	out := captureStdout(t, func () {
+		err = previewFileEdit(edit, Options{DryRun: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"--- " + path, "+++ " + path, ": Title\n", ": New\n", "# The tag would be written in place."} {
+		if !strings.Contains(out, line) {
+			t.Errorf("the preview doesn't contain %q:\n%s", line, out)
+		}
+	}
+	written, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(written, data) {
+		t.Errorf("the preview changed the file")
+	}
+}
+
+// Read-only frames can only be changed with --force, and frames that
+// ask to be discarded when the tag changes are, unless they're given.
+func TestEditFrameFlags(t *testing.T) {
+	data := makeTestTag(3,
+		makeTestFrame(3, "TIT2", []byte{0x20, 0x00}, []byte("\x00Title")),
+		makeTestFrame(3, "TPE1", []byte{0x80, 0x00}, []byte("\x00Artist")),
+		makeTestFrame(3, "TALB", nil, []byte("\x00Album")))
+	path := writeTestFile(t, data)
+
+	_, _, err := planFileEdit(FileEdit{Path: path, Fields: []FieldEdit{{Key: "Title", Value: "New"}}}, Options{ })
+	if err == nil {
+		t.Errorf("a read-only frame was changed without --force")
+	}
+
+	tests := []struct {
+		doc  string
+		want []string
+	}{
+		{"Title: New\n", []string{"TIT2 New", "TALB Album"}},
+		{"Album: New\n", []string{"TIT2 Title", "TALB New"}},
+		{"Artist: New\n", []string{"TIT2 Title", "TPE1 New", "TALB Album"}},
+	}
+	for _, test := range tests {
+		items, _ := planDocument(t, []byte("[" + path + "]\n" + test.doc), Options{Force: true})
+		var frames []string
+		for _, frame := range items[0].Tag.Frames {
+			frames = append(frames, frame.Header.Id + " " + frameValue(frame))
+		}
+		if !areValuesEqual(frames, test.want) {
+			t.Errorf("%q: frames are %q, want %q", test.doc, frames, test.want)
+		}
+	}
+
+	// The flags are written back.
+	items, _ := planDocument(t, []byte("[" + path + "]\nArtist: New\n"), Options{Force: true})
+	written, err := makeTagBytes(items[0].Tag, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(written[10:], makeTestFrame(3, "TIT2", []byte{0x20, 0x00}, []byte("\x00Title"))) {
+		t.Errorf("the read-only flag wasn't kept")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+
+// Lines starting with this are added to the edit document to report
+// problems. They're comments, so the lexer ignores them, and they're
+// removed before the document is reopened.
+const EDITORNOTEPREFIX = "# edid3: "
+
+
+// actOnEdit writes the tags of the given files to a temporary edit
+// document, opens that in the user's editor, and applies the document
+// when the editor exits. Files whose tags can't be written are left
+// out. A value whose line is removed from a file's section is removed
+// from its tag. If the document has problems, it's reopened with the
+// problems noted in comments. If it's saved unchanged, or emptied of
+// files, nothing is written, and the same goes for a document with
+// problems that's saved again without changes.
+func actOnEdit(args []string, options Options) {
+	var doc bytes.Buffer
+	for _, arg := range args {
+		item, err := itemFromFile(arg, options)
+		if err == nil {
+			err = checkItemEditable(item)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		printItemData(&doc, item, options.Separator)
+		fmt.Fprintln(&doc)
+	}
+	if doc.Len() == 0 {
+		return
+	}
+
+	temp, err := ioutil.TempFile("", "edid3-*.txt")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't create temporary file (%s).\n", err)
+		return
+	}
+	defer os.Remove(temp.Name())
+	temp.Close()
+
+	original := doc.Bytes()
+	// The files printed, whose sections give all of their frames.
+	printed := make(map[string]bool)
+	lexer := newLexer(bufio.NewReader(bytes.NewReader(original)))
+	printed_edits, _ := readFileEdits(&lexer)
+	for _, edit := range printed_edits {
+		printed[edit.Path] = true
+	}
+	text := original
+	// The document as it was last shown, without notes.
+	shown := original
+	for {
+		err := ioutil.WriteFile(temp.Name(), text, 0600)
+		if err == nil {
+			err = runEditor(temp.Name())
+		}
+		if err == nil {
+			text, err = ioutil.ReadFile(temp.Name())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return
+		}
+
+		text = removeEditorNotes(text)
+		if bytes.Equal(text, original) {
+			fmt.Println("No changes.")
+			return
+		}
+
+		edits, problems := checkEditDocument(text, printed, options)
+		if ((len(problems) == 0) && (len(edits) == 0)) {
+			fmt.Println("No files left in the document. No changes were made.")
+			return
+		} else if len(problems) == 0 {
+			applyFileEdits(edits, options)
+			return
+		} else if bytes.Equal(text, shown) {
+			printEditorProblems(problems)
+			fmt.Fprintln(os.Stderr, "The document was saved unchanged. No changes were made.")
+			return
+		}
+		shown = text
+		text = addEditorNotes(text, problems)
+	}
+}
+
+// runEditor opens the file in the editor named by $VISUAL or $EDITOR,
+// falling back to vi. The editor is run through the shell, so those
+// variables can include arguments.
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	cmd := exec.Command("sh", "-c", editor + " \"$1\"", "sh", path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Editor '%s' failed (%s). No changes were made.", editor, err))
+	}
+	return nil
+}
+
+// checkEditDocument parses the edit document and checks each of its
+// edits against its file's tag. The edits of the files that were
+// `printed` are complete. It returns the edits and a map of problems,
+// keyed by the path of the file they concern. Problems not specific to
+// a file have an empty key.
+func checkEditDocument(text []byte, printed map[string]bool, options Options) ([]FileEdit, map[string][]string) {
+	problems := make(map[string][]string)
+
+	lexer := newLexer(bufio.NewReader(bytes.NewReader(text)))
+	edits, err := readFileEdits(&lexer)
+	if err != nil {
+		problems[""] = append(problems[""], err.Error())
+		return edits, problems
+	}
+
+	for i, edit := range edits {
+		edits[i].Complete = printed[edit.Path]
+		_, _, err := planFileEdit(edits[i], options)
+		if err != nil {
+			problems[edit.Path] = append(problems[edit.Path], err.Error())
+		}
+	}
+	return edits, problems
+}
+
+// printEditorProblems prints the problems the edit document was last
+// shown with, the general ones first.
+func printEditorProblems(problems map[string][]string) {
+	var paths []string
+	for path := range problems {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, problem := range problems[path] {
+			fmt.Fprintf(os.Stderr, "%s\n", problem)
+		}
+	}
+}
+
+// addEditorNotes adds the problems to the edit document as comments.
+// A problem with a file is noted under the line giving the file's
+// path. Others, and those whose file can't be found, go at the top.
+func addEditorNotes(text []byte, problems map[string][]string) []byte {
+	var out bytes.Buffer
+	lines := strings.SplitAfter(string(text), "\n")
+
+	noted := make(map[string]bool)
+	var body bytes.Buffer
+	for _, line := range lines {
+		body.WriteString(line)
+		path := editorLinePath(line)
+		if ((path != "") && (!noted[path]) && (len(problems[path]) > 0)) {
+			if !strings.HasSuffix(line, "\n") {
+				body.WriteString("\n")
+			}
+			for _, problem := range problems[path] {
+				body.WriteString(EDITORNOTEPREFIX + problem + "\n")
+			}
+			noted[path] = true
+		}
+	}
+
+	for path, list := range problems {
+		if !noted[path] {
+			for _, problem := range list {
+				out.WriteString(EDITORNOTEPREFIX + problem + "\n")
+			}
+		}
+	}
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// editorLinePath returns the file path given on a line like
+// [3:/path/to/file], or an empty string if the line doesn't give one.
+func editorLinePath(line string) string {
+	lexer := newLexer(bufio.NewReader(strings.NewReader(line)))
+	for lexer.More() {
+		token, err := lexer.Next()
+		if err != nil {
+			return ""
+		}
+		if token.Type == TokenFilePath {
+			return token.Value
+		} else if token.Type != TokenFileVersion {
+			return ""
+		}
+	}
+	return ""
+}
+
+func removeEditorNotes(text []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(text), "\n") {
+		if !strings.HasPrefix(line, EDITORNOTEPREFIX) {
+			out.WriteString(line)
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// The keyring can be set with this environment variable. It defaults
+// to ~/.edid3/keyring. Each line holds an owner identifier, as given
+// in ENCR frames, and that owner's key in hex, separated by blanks.
+// Empty lines and lines starting with # are ignored.
+const KEYRINGENV = "EDID3_KEYRING"
+
+
+// The ciphers registered with `registerFrameCipher`, by owner.
+var frameCiphers = make(map[string]FrameCipher)
+
+
+// registerFrameCipher makes the cipher decrypt and encrypt the frames
+// encrypted with the methods the owner registers in ENCR frames. A
+// cipher can be added by a file in this package that calls this from
+// its `init` function.
+func registerFrameCipher(owner string, cipher FrameCipher) {
+	frameCiphers[owner] = cipher
+}
+
+// readEncryptionMethods returns the encryption methods registered by
+// the ENCR frames. Each body holds:
+// - the owner identifier, ISO-8859-1 text ending in a null byte
+// - the method symbol, one byte
+// - the encryption data, the rest of the body
+// ENCR frames that don't hold all of those are ignored.
+func readEncryptionMethods(frames []ID3v2Frame) []EncryptionMethod {
+	var methods []EncryptionMethod
+	for _, frame := range frames {
+		if frame.Header.Id != "ENCR" {
+			continue
+		}
+		end := bytes.IndexByte(frame.Body, 0)
+		if ((end < 0) || (end + 1 >= len(frame.Body))) {
+			continue
+		}
+		method := EncryptionMethod{
+			Owner: ISO8859_1ToUTF8(frame.Body[:end]),
+			Symbol: frame.Body[end + 1],
+			Data: frame.Body[end + 2:],
+		}
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// findFrameCipher returns the method registered with the symbol, and
+// the cipher and key for the method's owner. It returns false if any
+// of those is missing.
+func findFrameCipher(methods []EncryptionMethod, keyring map[string][]byte, symbol byte) (EncryptionMethod, FrameCipher, []byte, bool) {
+	for _, method := range methods {
+		if method.Symbol == symbol {
+			cipher, has_cipher := frameCiphers[method.Owner]
+			key, has_key := keyring[method.Owner]
+			return method, cipher, key, ((has_cipher) && (has_key))
+		}
+	}
+	return EncryptionMethod{ }, nil, nil, false
+}
+
+// decryptFrames decrypts the encrypted frames that a registered cipher
+// and a key in the keyring can be found for, and then inflates them
+// if they're compressed. Other encrypted frames are left as they are,
+// and so are frames that fail to decrypt, though the first of those
+// failures is returned once the rest are decrypted.
+func decryptFrames(frames []ID3v2Frame, max_inflate int) error {
+	methods := readEncryptionMethods(frames)
+	if ((len(methods) == 0) || (len(frameCiphers) == 0)) {
+		return nil
+	}
+	keyring, err := readKeyring()
+	if err != nil {
+		return err
+	}
+
+	var failed error
+	for i, frame := range frames {
+		if !frame.Header.Flags.Encrypted {
+			continue
+		}
+		method, cipher, key, ok := findFrameCipher(methods, keyring, frame.Header.EncryptionMethod)
+		if !ok {
+			continue
+		}
+
+		body, err := cipher.Decrypt(method, key, frame.Body)
+		if err != nil {
+			err = newParseError(ErrDecryption, err.Error())
+		} else if frame.Header.Flags.Compressed {
+			body, err = inflate(body, max_inflate)
+		}
+		if err != nil {
+			if failed == nil {
+				failed = withFrameId(err, frame.Header.Id)
+			}
+			continue
+		}
+		frames[i].Body = body
+		frames[i].Header.Size = len(body)
+		frames[i].Header.Decrypted = true
+	}
+	return failed
+}
+
+// encryptFrameBody is the inverse of `decryptFrames` for one frame's
+// body, which should already be compressed if it's to be.
+func encryptFrameBody(frame ID3v2Frame, methods []EncryptionMethod, keyring map[string][]byte) ([]byte, error) {
+	method, cipher, key, ok := findFrameCipher(methods, keyring, frame.Header.EncryptionMethod)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Can't encrypt frame %s: no cipher or key for method %d.", frame.Header.Id, frame.Header.EncryptionMethod))
+	}
+	body, err := cipher.Encrypt(method, key, frame.Body)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't encrypt frame %s (%s).", frame.Header.Id, err))
+	}
+	return body, nil
+}
+
+// isFrameReadable returns false if the frame is encrypted and hasn't
+// been decrypted, so its body can't be shown or edited.
+func isFrameReadable(frame ID3v2Frame) bool {
+	return ((!frame.Header.Flags.Encrypted) || (frame.Header.Decrypted))
+}
+
+func keyringPath() (string, error) {
+	path := os.Getenv(KEYRINGENV)
+	if path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Can't find the keyring (%s).", err))
+	}
+	return filepath.Join(home, ".edid3", "keyring"), nil
+}
+
+// readKeyring returns the keys in the keyring by owner. A missing
+// keyring has no keys, and one that other users can get at isn't
+// read.
+func readKeyring() (map[string][]byte, error) {
+	keyring := make(map[string][]byte)
+
+	path, err := keyringPath()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return keyring, nil
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't open keyring '%s' (%s).", path, err))
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't open keyring '%s' (%s).", path, err))
+	}
+	if info.Mode().Perm() & 0077 != 0 {
+		return nil, errors.New(fmt.Sprintf("Won't read keyring '%s': other users can access it. Make it private with `chmod 600`.", path))
+	}
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if ((line == "") || (strings.HasPrefix(line, "#"))) {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf("Can't read keyring '%s': line %d should hold an owner and a key.", path, n))
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Can't read keyring '%s': the key on line %d isn't hex.", path, n))
+		}
+		keyring[fields[0]] = key
+	}
+	return keyring, scanner.Err()
+}
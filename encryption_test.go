@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+
+const TESTCIPHEROWNER = "test@example.com"
+
+
+// xorCipher is a toy cipher for the tests: each byte is XORed with the
+// key.
+type xorCipher struct{ }
+
+func (cipher xorCipher) Decrypt(method EncryptionMethod, key []byte, data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ key[i % len(key)]
+	}
+	return out, nil
+}
+
+func (cipher xorCipher) Encrypt(method EncryptionMethod, key []byte, data []byte) ([]byte, error) {
+	return cipher.Decrypt(method, key, data)
+}
+
+// useTestCipher registers `xorCipher` for `TESTCIPHEROWNER` and points
+// the keyring at one holding its key, for the length of the test.
+func useTestCipher(t *testing.T, key string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keyring")
+	err := ioutil.WriteFile(path, []byte(TESTCIPHEROWNER + " " + key + "\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(KEYRINGENV, path)
+
+	registerFrameCipher(TESTCIPHEROWNER, xorCipher{ })
+	t.Cleanup(func () {
+		delete(frameCiphers, TESTCIPHEROWNER)
+	})
+}
+
+func TestReadEncryptedFrames(t *testing.T) {
+	useTestCipher(t, "5a")
+
+	secret, _ := xorCipher{ }.Encrypt(EncryptionMethod{ }, []byte{0x5a}, []byte("\x00Secret"))
+	encr := append([]byte(TESTCIPHEROWNER + "\x00"), 0x80)
+	data := makeTestTag(4,
+		makeTestFrame(4, "ENCR", nil, encr),
+		makeTestFrame(4, "TIT2", []byte{0x00, 0x04}, append([]byte{0x80}, secret...)),
+		makeTestFrame(4, "TALB", nil, []byte("\x00Album")))
+	path := writeTestFile(t, data)
+
+	for _, tolerant := range []bool{false, true} {
+		item, err := itemFromFile(path, Options{Tolerant: tolerant})
+		if err != nil {
+			t.Fatalf("tolerant=%v: %v", tolerant, err)
+		}
+		n := findFrame(item.Tag.Frames, "TIT2")
+		if n < 0 {
+			t.Fatalf("tolerant=%v: no TIT2 frame", tolerant)
+		}
+		if !isFrameReadable(item.Tag.Frames[n]) {
+			t.Errorf("tolerant=%v: TIT2 wasn't decrypted", tolerant)
+		} else if value := frameValue(item.Tag.Frames[n]); value != "Secret" {
+			t.Errorf("tolerant=%v: TIT2 is %q, want %q", tolerant, value, "Secret")
+		}
+	}
+}
+
+func TestReadEncryptedFramesWithoutKey(t *testing.T) {
+	useTestCipher(t, "5a")
+	t.Setenv(KEYRINGENV, filepath.Join(t.TempDir(), "missing"))
+
+	encr := append([]byte(TESTCIPHEROWNER + "\x00"), 0x80)
+	data := makeTestTag(4,
+		makeTestFrame(4, "ENCR", nil, encr),
+		makeTestFrame(4, "TIT2", []byte{0x00, 0x04}, []byte{0x80, 0x01, 0x02}))
+	path := writeTestFile(t, data)
+
+	item, err := itemFromFile(path, Options{ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := findFrame(item.Tag.Frames, "TIT2")
+	if ((n < 0) || (isFrameReadable(item.Tag.Frames[n]))) {
+		t.Errorf("TIT2 should be kept encrypted without a key")
+	}
+}
+
+// A keyring other users can read is refused, which is reported, and
+// the other frames are read anyway.
+func TestReadEncryptedFramesWithOpenKeyring(t *testing.T) {
+	useTestCipher(t, "5a")
+	err := os.Chmod(os.Getenv(KEYRINGENV), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _ := xorCipher{ }.Encrypt(EncryptionMethod{ }, []byte{0x5a}, []byte("\x00Secret"))
+	encr := append([]byte(TESTCIPHEROWNER + "\x00"), 0x80)
+	data := makeTestTag(4,
+		makeTestFrame(4, "ENCR", nil, encr),
+		makeTestFrame(4, "TIT2", []byte{0x00, 0x04}, append([]byte{0x80}, secret...)),
+		makeTestFrame(4, "TALB", nil, []byte("\x00Album")))
+	path := writeTestFile(t, data)
+
+	item, err := itemFromFile(path, Options{ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := findFrame(item.Tag.Frames, "TIT2")
+	if ((n < 0) || (isFrameReadable(item.Tag.Frames[n]))) {
+		t.Errorf("TIT2 should be kept encrypted")
+	}
+	if value := frameText(item.Tag.Frames, "TALB"); value != "Album" {
+		t.Errorf("TALB is %q, want %q", value, "Album")
+	}
+	if ((item.Diagnostics == nil) || (len(item.Diagnostics.Problems) != 1)) {
+		t.Errorf("the keyring wasn't reported")
+	} else if !strings.Contains(item.Diagnostics.Problems[0], "other users") {
+		t.Errorf("the problem is %q", item.Diagnostics.Problems[0])
+	}
+}
+
+// A decrypted frame is encrypted again when it's written.
+func TestWriteEncryptedFrames(t *testing.T) {
+	useTestCipher(t, "5a")
+
+	secret, _ := xorCipher{ }.Encrypt(EncryptionMethod{ }, []byte{0x5a}, []byte("\x00Secret"))
+	encr := append([]byte(TESTCIPHEROWNER + "\x00"), 0x80)
+	stored := makeTestFrame(4, "TIT2", []byte{0x00, 0x04}, append([]byte{0x80}, secret...))
+	data := makeTestTag(4, makeTestFrame(4, "ENCR", nil, encr), stored)
+	item, err := itemFromFile(writeTestFile(t, data), Options{ })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := makeTagBytes(item.Tag, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(written, stored) {
+		t.Errorf("TIT2 wasn't written encrypted as it was read")
+	}
+}
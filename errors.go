@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+
+// The kinds of error met while reading tags and edit documents. They
+// are returned wrapped in a `ParseError`, which says where the error
+// happened. Use `errors.Is` to check an error's kind.
+var (
+	ErrNoTag              = errors.New("no ID3v2 tag")
+	ErrUnsupportedVersion = errors.New("unsupported tag version")
+	ErrTruncatedTag       = errors.New("truncated tag")
+	ErrBadFrameHeader     = errors.New("bad frame header")
+	ErrBadExtendedHeader  = errors.New("bad extended header")
+	ErrBadChecksum        = errors.New("CRC-32 doesn't match")
+	ErrCompression        = errors.New("bad compressed data")
+	ErrDecryption         = errors.New("can't decrypt frame")
+	ErrLexerSyntax        = errors.New("syntax error")
+)
+
+
+type ParseError struct {
+	Kind    error
+	// The file the error is in. Empty for errors in edit documents,
+	// and until the error reaches `itemFromFile`.
+	Path    string
+	// The ID of the frame the error is in, if any.
+	FrameId string
+	// Where in the file the frame, or the tag if there's no frame,
+	// starts. -1 if it isn't known.
+	Offset  int
+	// For truncated data, the number of bytes the tag said there
+	// would be and the number there were.
+	Declared  int
+	Available int
+	Detail  string
+}
+
+func (err *ParseError) Error() string {
+	msg := err.Kind.Error()
+	if err.FrameId != "" {
+		msg = fmt.Sprintf("%s in frame %s", msg, err.FrameId)
+	}
+	if err.Offset >= 0 {
+		msg = fmt.Sprintf("%s at offset %d", msg, err.Offset)
+	}
+	if err.Declared > 0 {
+		msg = fmt.Sprintf("%s (declared %d bytes, %d available)", msg, err.Declared, err.Available)
+	}
+	if err.Detail != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, err.Detail)
+	}
+	if err.Path != "" {
+		msg = fmt.Sprintf("Error in '%s': %s", err.Path, msg)
+	} else {
+		msg = "Error: " + msg
+	}
+	return msg + "."
+}
+
+func (err *ParseError) Unwrap() error {
+	return err.Kind
+}
+
+func newParseError(kind error, detail string) *ParseError {
+	return &ParseError{Kind: kind, Offset: -1, Detail: detail}
+}
+
+func newTruncatedError(declared int, available int) *ParseError {
+	err := newParseError(ErrTruncatedTag, "")
+	err.Declared = declared
+	err.Available = available
+	return err
+}
+
+// withPath sets the path of the error if it's a `ParseError` without
+// one. Other errors are returned unchanged.
+func withPath(err error, path string) error {
+	var parse_err *ParseError
+	if ((errors.As(err, &parse_err)) && (parse_err.Path == "")) {
+		parse_err.Path = path
+	}
+	return err
+}
+
+// withOffset sets the offset of the error if it's a `ParseError`
+// without one.
+func withOffset(err error, offset int) error {
+	var parse_err *ParseError
+	if ((errors.As(err, &parse_err)) && (parse_err.Offset < 0)) {
+		parse_err.Offset = offset
+	}
+	return err
+}
+
+// withFrameId sets the frame ID of the error if it's a `ParseError`
+// without one.
+func withFrameId(err error, id string) error {
+	var parse_err *ParseError
+	if ((errors.As(err, &parse_err)) && (parse_err.FrameId == "")) {
+		parse_err.FrameId = id
+	}
+	return err
+}
+
+// withBaseOffset moves the offset of the error, if it's a `ParseError`
+// with one, by `base`. Offsets in a tag are counted from its start, so
+// this makes them count from the start of the file for a tag that
+// isn't there.
+func withBaseOffset(err error, base int) error {
+	var parse_err *ParseError
+	if ((errors.As(err, &parse_err)) && (parse_err.Offset >= 0)) {
+		parse_err.Offset += base
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+
+// Files that can't be read give an error of the right kind instead of
+// a panic.
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"no tag", testAudio, ErrNoTag},
+		{"empty", []byte{ }, ErrNoTag},
+		{"version", append([]byte("ID3\x05\x00\x00"), synchsafeIntToBytes(10)...), ErrUnsupportedVersion},
+		{"header", []byte("ID3\x03"), ErrTruncatedTag},
+		{"frame", makeTestTag(3, []byte("TIT2\x00\x00\x00\x64\x00\x00\x00Title")), ErrTruncatedTag},
+		{"frame format", makeTestTag(3, makeTestFrame(3, "TIT2", []byte{0x00, 0x80}, []byte("\x00\x00"))), ErrBadFrameHeader},
+	}
+	for _, test := range tests {
+		_, err := itemFromFile(writeTestFile(t, test.data), Options{ })
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: error is %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+// A truncated tag's error says where it is, and how many bytes there
+// should have been and were.
+func TestTruncatedTagOffsets(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		offset    int
+		frame     string
+		declared  int
+		available int
+	}{
+		{"tag", append([]byte("ID3\x03\x00\x00"), synchsafeIntToBytes(100)...), 0, "", 110, 10},
+		{"frame", makeTestTag(3, []byte("TIT2\x00\x00\x00\x64\x00\x00\x00Title")), 10, "TIT2", 100, 22},
+	}
+	for _, test := range tests {
+		_, err := itemFromFile(writeTestFile(t, test.data), Options{ })
+		var parse_err *ParseError
+		if !errors.As(err, &parse_err) {
+			t.Errorf("%s: error is %v", test.name, err)
+			continue
+		}
+		if ((parse_err.Offset != test.offset) || (parse_err.FrameId != test.frame) ||
+			(parse_err.Declared != test.declared) || (parse_err.Available != test.available)) {
+			t.Errorf("%s: error is %v", test.name, err)
+		}
+	}
+}
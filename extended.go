@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+
+// checkExtendedHeaderCRC checks the CRC in the extended header, if it
+// has one, against the data following the extended header. In v2.3
+// the CRC covers only the frames, so the padding is left out.
+func checkExtendedHeaderCRC(version int, extended ID3v2ExtendedHeader, data []byte) error {
+	if !extended.HasCRC {
+		return nil
+	}
+	if version == 3 {
+		data = data[:len(data) - extended.PaddingSize]
+	}
+	crc := crc32.ChecksumIEEE(data)
+	if crc != extended.CRC {
+		return newParseError(ErrBadChecksum, fmt.Sprintf("expected %08X, got %08X", extended.CRC, crc))
+	}
+	return nil
+}
+
+// describeTagRestrictions returns a description of each restriction
+// in effect. The tag size is always restricted.
+// Refer to section 3.2 of http://id3.org/id3v2.4.0-structure
+func describeTagRestrictions(restrictions TagRestrictions) []string {
+	var descriptions []string
+
+	tag_sizes := [...]string{
+		"no more than 128 frames and 1 MB",
+		"no more than 64 frames and 128 KB",
+		"no more than 32 frames and 40 KB",
+		"no more than 32 frames and 4 KB",
+	}
+	descriptions = append(descriptions, "tag has " + tag_sizes[restrictions.TagSize])
+
+	if restrictions.TextEncoding == 1 {
+		descriptions = append(descriptions, "text is ISO-8859-1 or UTF-8")
+	}
+
+	text_sizes := [...]string{"", "1024", "128", "30"}
+	if restrictions.TextSize > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("text fields have no more than %s characters", text_sizes[restrictions.TextSize]))
+	}
+
+	if restrictions.ImageEncoding == 1 {
+		descriptions = append(descriptions, "images are PNG or JPEG")
+	}
+
+	image_sizes := [...]string{"", "256x256 pixels or less", "64x64 pixels or less", "exactly 64x64 pixels"}
+	if restrictions.ImageSize > 0 {
+		descriptions = append(descriptions, "images are " + image_sizes[restrictions.ImageSize])
+	}
+
+	return descriptions
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"hash/crc32"
+	"testing"
+)
+
+
+// makeTestExtendedTag returns a tag with an extended header holding
+// the CRC, and the frames. The CRC covers the frames in v2.3, and the
+// frames and padding in v2.4.
+func makeTestExtendedTag(version int, frames []byte, crc uint32) []byte {
+	padding := make([]byte, 16)
+	var extended []byte
+	if version == 3 {
+		extended = append([]byte{0, 0, 0, 10, 0x80, 0}, intToBytes(len(padding), 4)...)
+		extended = append(extended, intToBytes(int(crc), 4)...)
+	} else {
+		// A CRC of 32 bits takes five synchsafe bytes.
+		crc_data := append([]byte{byte(crc >> 28)}, synchsafeIntToBytes(int(crc & 0x0fffffff))...)
+		extended = append([]byte{0, 0, 0, 12, 1, 0x20, 5}, crc_data...)
+	}
+	body := append(append(extended, frames...), padding...)
+	data := append([]byte{'I', 'D', '3', byte(version), 0, 0x40}, synchsafeIntToBytes(len(body))...)
+	return append(append(data, body...), testAudio...)
+}
+
+// A bad CRC is reported, and the frames are read anyway.
+func TestReadExtendedHeaderCRC(t *testing.T) {
+	for _, version := range []int{3, 4} {
+		frames := makeTestFrame(version, "TIT2", nil, []byte("\x00Title"))
+		crc := crc32.ChecksumIEEE(frames)
+		if version == 4 {
+			crc = crc32.ChecksumIEEE(append(frames, make([]byte, 16)...))
+		}
+
+		for _, good := range []bool{true, false} {
+			if !good {
+				crc ^= 0xff
+			}
+			path := writeTestFile(t, makeTestExtendedTag(version, frames, crc))
+			item, err := itemFromFile(path, Options{ })
+			if err != nil {
+				t.Fatalf("v2.%d: %v", version, err)
+			}
+			if value := frameText(item.Tag.Frames, "TIT2"); value != "Title" {
+				t.Errorf("v2.%d: TIT2 is %q, want %q", version, value, "Title")
+			}
+			reported := ((item.Diagnostics != nil) && (len(item.Diagnostics.Problems) == 1))
+			if reported == good {
+				t.Errorf("v2.%d: the CRC problem is reported: %v, want %v", version, reported, !good)
+			}
+		}
+	}
+}
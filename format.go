@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+
+// The default limit on the size of a compressed frame's body once
+// it's inflated. It can be changed with --max-inflate.
+const V2MAXINFLATESIZE = 16 << 20
+
+// With --compress, frames at least this large are compressed when
+// they're written, unless they hold pictures, which are compressed
+// already.
+const V2COMPRESSSIZE = 1024
+
+
+// The format flags of a v2.3 or v2.4 frame can add data to the start
+// of its body: the group ID, the encryption method, and the size of
+// the body once decompressed (v2.3) or without any formatting (v2.4,
+// the data length indicator). They come in the order of their flags,
+// which differs between the versions:
+// v2.3: size, encryption method, group ID
+// v2.4: group ID, encryption method, data length
+//
+// When a frame is read, that data is moved into its header and its
+// body is inflated if it's compressed, so a frame's body is always
+// its content. The flags are kept, and say how the frame is to be
+// written. The exception is an encrypted frame, whose body is left
+// as it's stored, compressed or not, until `decryptFrames` decrypts
+// it.
+
+// readFrameFormat moves the data the frame's format flags add to its
+// body into its header, and inflates the body if it's compressed. The
+// inflated body can't be larger than `max_size`.
+func readFrameFormat(version int, frame ID3v2Frame, max_size int) (ID3v2Frame, error) {
+	if version == 2 {
+		return frame, nil
+	}
+
+	flags := frame.Header.Flags
+	body := frame.Body
+	missing := withFrameId(newParseError(ErrBadFrameHeader, "body is too short for its flags"), frame.Header.Id)
+
+	if version == 3 {
+		if flags.Compressed {
+			if len(body) < 4 {
+				return frame, missing
+			}
+			frame.Header.DataLength = bytesToInt(body[:4])
+			body = body[4:]
+		}
+		if flags.Encrypted {
+			if len(body) < 1 {
+				return frame, missing
+			}
+			frame.Header.EncryptionMethod = body[0]
+			body = body[1:]
+		}
+		if flags.Grouped {
+			if len(body) < 1 {
+				return frame, missing
+			}
+			frame.Header.GroupId = body[0]
+			body = body[1:]
+		}
+	} else {
+		if flags.Grouped {
+			if len(body) < 1 {
+				return frame, missing
+			}
+			frame.Header.GroupId = body[0]
+			body = body[1:]
+		}
+		if flags.Encrypted {
+			if len(body) < 1 {
+				return frame, missing
+			}
+			frame.Header.EncryptionMethod = body[0]
+			body = body[1:]
+		}
+		if flags.HasDataLength {
+			if len(body) < 4 {
+				return frame, missing
+			}
+			frame.Header.DataLength = synchsafeBytesToInt(body[:4])
+			body = body[4:]
+		}
+	}
+
+	if ((flags.Compressed) && (!flags.Encrypted)) {
+		inflated, err := inflate(body, max_size)
+		if err != nil {
+			return frame, withFrameId(err, frame.Header.Id)
+		}
+		body = inflated
+	}
+
+	frame.Body = body
+	frame.Header.Size = len(body)
+	return frame, nil
+}
+
+// makeFrameFormat is the inverse of `readFrameFormat` and, for frames
+// that were decrypted, `decryptFrames`. It returns the frame with its
+// body as it's to be stored.
+func makeFrameFormat(version int, frame ID3v2Frame, methods []EncryptionMethod, keyring map[string][]byte) (ID3v2Frame, error) {
+	if version == 2 {
+		return frame, nil
+	}
+
+	flags := frame.Header.Flags
+	body := frame.Body
+	// The body of an encrypted frame that wasn't decrypted is stored
+	// as it was read.
+	plain := ((!flags.Encrypted) || (frame.Header.Decrypted))
+	data_length := frame.Header.DataLength
+	if plain {
+		data_length = len(body)
+	}
+	if ((flags.Compressed) && (plain)) {
+		deflated, err := deflate(body)
+		if err != nil {
+			return frame, err
+		}
+		body = deflated
+	}
+	if ((flags.Encrypted) && (frame.Header.Decrypted)) {
+		frame.Body = body
+		encrypted, err := encryptFrameBody(frame, methods, keyring)
+		if err != nil {
+			return frame, err
+		}
+		body = encrypted
+	}
+
+	var prefix []byte
+	if version == 3 {
+		if flags.Compressed {
+			prefix = append(prefix, intToBytes(data_length, 4)...)
+		}
+		if flags.Encrypted {
+			prefix = append(prefix, frame.Header.EncryptionMethod)
+		}
+		if flags.Grouped {
+			prefix = append(prefix, frame.Header.GroupId)
+		}
+		// v2.3 has no data length indicator.
+		frame.Header.Flags.HasDataLength = false
+	} else {
+		// A compressed v2.4 frame must have a data length indicator.
+		if flags.Compressed {
+			frame.Header.Flags.HasDataLength = true
+		}
+		if flags.Grouped {
+			prefix = append(prefix, frame.Header.GroupId)
+		}
+		if flags.Encrypted {
+			prefix = append(prefix, frame.Header.EncryptionMethod)
+		}
+		if frame.Header.Flags.HasDataLength {
+			prefix = append(prefix, synchsafeIntToBytes(data_length)...)
+		}
+	}
+
+	frame.Body = append(prefix, body...)
+	frame.Header.Size = len(frame.Body)
+	return frame, nil
+}
+
+// inflate decompresses zlib data, failing if the result would be more
+// than `max_size` bytes.
+func inflate(data []byte, max_size int) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, newParseError(ErrCompression, err.Error())
+	}
+	defer reader.Close()
+
+	// One byte more than the limit is read, to tell whether there's
+	// more than the limit.
+	inflated, err := ioutil.ReadAll(io.LimitReader(reader, int64(max_size) + 1))
+	if err != nil {
+		return nil, newParseError(ErrCompression, err.Error())
+	}
+	if len(inflated) > max_size {
+		return nil, newParseError(ErrCompression, fmt.Sprintf("inflates to more than %d bytes", max_size))
+	}
+	return inflated, nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	writer := zlib.NewWriter(&out)
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't compress frame (%s).", err))
+	}
+	return out.Bytes(), nil
+}
+
+// markFramesForCompression sets the Compressed flag of each frame in
+// the tag that's large enough to be worth compressing.
+func markFramesForCompression(tag *ID3v2Tag) {
+	if tag.Header.Version == 2 {
+		return
+	}
+	for i, frame := range tag.Frames {
+		id := frame.Header.Id
+		if ((len(frame.Body) >= V2COMPRESSSIZE) && (id != "APIC") && (!frame.Header.Flags.Encrypted)) {
+			tag.Frames[i].Header.Flags.Compressed = true
+		}
+	}
+}
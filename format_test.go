@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+
+// A compressed frame that inflates past the limit isn't inflated.
+func TestInflateLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	deflated, err := deflate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inflated, err := inflate(deflated, 100)
+	if ((err != nil) || (!bytes.Equal(inflated, data))) {
+		t.Errorf("inflated to %d bytes (%v)", len(inflated), err)
+	}
+	_, err = inflate(deflated, 99)
+	if !errors.Is(err, ErrCompression) {
+		t.Errorf("error is %v, want a compression error", err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+
+// The journal directory can be set with this environment variable.
+// It defaults to ~/.edid3/journal.
+const JOURNALDIRENV = "EDID3_JOURNAL"
+const JOURNALINDEXNAME = "index.jsonl"
+
+
+// The journal keeps a backup of each tag before it's overwritten.
+// Each run of the program that writes tags gets its own directory in
+// the journal, called a batch. A batch contains a copy of each tag it
+// replaced and an index, which holds one JSON-encoded `JournalEntry`
+// per line, in the order the tags were written.
+
+func journalDir() (string, error) {
+	dir := os.Getenv(JOURNALDIRENV)
+	if dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Can't find the journal directory (%s).", err))
+	}
+	return filepath.Join(home, ".edid3", "journal"), nil
+}
+
+// openJournal opens the named batch in the journal. If the name is
+// empty, a new batch named after the current time is opened. The
+// batch's directory isn't created until a tag is recorded in it.
+func openJournal(name string) (*Journal, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", time.Now().Format("20060102T150405"), os.Getpid())
+	}
+
+	journal := Journal{Name: name, Dir: filepath.Join(dir, name)}
+	entries, err := readJournalEntries(journal.Dir)
+	if err != nil {
+		return nil, err
+	}
+	journal.Count = len(entries)
+
+	return &journal, nil
+}
+
+// Backup saves the file's current tag, the first `old_size` bytes of
+// the file, before it's overwritten. It returns the entry to pass to
+// `Commit` once the new tag is written, or to `Discard` if it can't
+// be.
+func (journal *Journal) Backup(path string, old_size int) (JournalEntry, error) {
+	entry := JournalEntry{Path: path}
+	old_tag, err := readFileStart(path, old_size)
+	if err != nil {
+		return entry, err
+	}
+
+	err = os.MkdirAll(journal.Dir, 0755)
+	if err != nil {
+		return entry, errors.New(fmt.Sprintf("Can't create journal batch '%s' (%s).", journal.Dir, err))
+	}
+
+	journal.Count++
+	entry.Backup = fmt.Sprintf("%04d.tag", journal.Count)
+	entry.OldChecksum = checksum(old_tag)
+	err = ioutil.WriteFile(filepath.Join(journal.Dir, entry.Backup), old_tag, 0644)
+	if err != nil {
+		journal.Discard(entry)
+		return entry, errors.New(fmt.Sprintf("Can't save backup of tag in '%s' (%s).", path, err))
+	}
+	return entry, nil
+}
+
+// Commit adds the entry to the batch's index once its file's new tag
+// has been written. The entry records a checksum of the tag and the
+// size of the file, so undo can tell if either has changed without
+// reading the rest of the file.
+func (journal *Journal) Commit(entry JournalEntry, tag []byte) error {
+	info, err := os.Stat(entry.Path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't stat file '%s' (%s).", entry.Path, err))
+	}
+	entry.Time = time.Now().Format(time.RFC3339Nano)
+	entry.NewChecksum = checksum(tag)
+	entry.NewSize = len(tag)
+	entry.FileSize = info.Size()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(filepath.Join(journal.Dir, JOURNALINDEXNAME), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't open journal index in '%s' (%s).", journal.Dir, err))
+	}
+	_, err = index.Write(append(line, '\n'))
+	close_err := index.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't write journal index in '%s' (%s).", journal.Dir, err))
+	}
+
+	return nil
+}
+
+// Discard removes the backup saved for a tag that wasn't written, and
+// the batch's directory if that leaves it empty.
+func (journal *Journal) Discard(entry JournalEntry) {
+	os.Remove(filepath.Join(journal.Dir, entry.Backup))
+	journal.Count--
+	if journal.Count == 0 {
+		os.Remove(journal.Dir)
+	}
+}
+
+func readJournalEntries(dir string) ([]JournalEntry, error) {
+	var entries []JournalEntry
+
+	file, err := os.Open(filepath.Join(dir, JOURNALINDEXNAME))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't open journal index in '%s' (%s).", dir, err))
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Can't read journal index in '%s' (%s).", dir, err))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// listJournalBatches returns the names of the batches in the journal,
+// oldest first. A batch is as old as the first tag it wrote, so one
+// that's reused keeps its place.
+func listJournalBatches() ([]string, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't read journal directory '%s' (%s).", dir, err))
+	}
+
+	type batch struct {
+		name string
+		time time.Time
+	}
+	var batches []batch
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		entries, err := readJournalEntries(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		written, err := time.Parse(time.RFC3339Nano, entries[0].Time)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Can't read journal index in '%s' (%s).", info.Name(), err))
+		}
+		batches = append(batches, batch{info.Name(), written})
+	}
+	sort.SliceStable(batches, func (i, j int) bool {
+		return batches[i].time.Before(batches[j].time)
+	})
+
+	var names []string
+	for _, b := range batches {
+		names = append(names, b.name)
+	}
+	return names, nil
+}
+
+// actOnUndo restores the tags replaced by batches in the journal. The
+// argument can be the name of a batch or the number of batches to
+// undo, starting with the latest. It defaults to 1.
+func actOnUndo(args []string) {
+	names, err := listJournalBatches()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	var undo []string
+	if len(args) == 0 {
+		args = []string{"1"}
+	}
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			for i := len(names) - 1; ((i >= 0) && (i >= len(names) - n)); i-- {
+				undo = append(undo, names[i])
+			}
+		} else {
+			undo = append(undo, arg)
+		}
+	}
+
+	if len(undo) == 0 {
+		fmt.Println("Nothing to undo.")
+	}
+	for _, name := range undo {
+		err := undoJournalBatch(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+}
+
+// undoJournalBatch restores the tags saved in the batch, latest first,
+// and then removes the batch from the journal. A file is skipped if
+// it has changed in any way since the batch wrote it, in which case
+// the batch is kept.
+func undoJournalBatch(name string) error {
+	dir, err := journalDir()
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, name)
+
+	entries, err := readJournalEntries(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.New(fmt.Sprintf("Journal batch '%s' doesn't exist or is empty.", name))
+	}
+
+	failed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		err := undoJournalEntry(dir, entries[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("Kept journal batch '%s': %d of its tags couldn't be restored.", name, failed))
+	}
+	fmt.Printf("Undid journal batch '%s' (%d tags restored).\n", name, len(entries))
+	return os.RemoveAll(dir)
+}
+
+func undoJournalEntry(dir string, entry JournalEntry) error {
+	info, err := os.Stat(entry.Path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't stat file '%s' (%s).", entry.Path, err))
+	}
+	changed := (info.Size() != entry.FileSize)
+	if !changed {
+		current, err := readFileStart(entry.Path, entry.NewSize)
+		if err != nil {
+			return err
+		}
+		changed = (checksum(current) != entry.NewChecksum)
+	}
+	if changed {
+		return errors.New(fmt.Sprintf("Can't restore tag in '%s': it has changed since %s.", entry.Path, entry.Time))
+	}
+
+	backup, err := ioutil.ReadFile(filepath.Join(dir, entry.Backup))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't read backup of tag in '%s' (%s).", entry.Path, err))
+	}
+	if checksum(backup) != entry.OldChecksum {
+		return errors.New(fmt.Sprintf("Can't restore tag in '%s': the backup is corrupt.", entry.Path))
+	}
+
+	if len(backup) == entry.NewSize {
+		return writeTagInPlace(entry.Path, backup)
+	}
+	return rewriteFile(entry.Path, backup, entry.NewSize)
+}
+
+// readFileStart returns the first `size` bytes of the file.
+func readFileStart(path string, size int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't open file '%s' (%s).", path, err))
+	}
+	defer file.Close()
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't read tag from '%s' (%s).", path, err))
+	}
+	return data, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+
+// writeTestTitles writes each title to the file's TIT2 frame in turn,
+// recording the writes in the named journal batch, and returns the
+// batch.
+func writeTestTitles(t *testing.T, path string, batch string, titles ...string) *Journal {
+	journal, err := openJournal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range titles {
+		item, err := itemFromFile(path, Options{ })
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Tag.Frames[0].Body = []byte(title)
+		err = writeItem(item, journal)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return journal
+}
+
+// Undoing a batch restores the file as it was, whether the writes
+// were made in place or by rewriting the file.
+func TestUndoJournalBatch(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	data := append(makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Title"))), testAudio...)
+	path := writeTestFile(t, data)
+
+	journal := writeTestTitles(t, path, "first", "\x00New", "\x00" + strings.Repeat("New title ", 400))
+	err := undoJournalBatch(journal.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(path)
+	if ((err != nil) || (!bytes.Equal(restored, data))) {
+		t.Errorf("undo didn't restore the file (%v)", err)
+	}
+}
+
+// A file whose tag has changed since the batch wrote it is left alone.
+func TestUndoChangedFile(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	path := writeTestFile(t, append(makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Title"))), testAudio...))
+
+	journal := writeTestTitles(t, path, "first", "\x00New")
+	writeTestTitles(t, path, "second", "\x00Newer")
+	err := undoJournalBatch(journal.Name)
+	if err == nil {
+		t.Errorf("undo restored a file that had changed")
+	}
+	item, err := itemFromFile(path, Options{ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := frameText(item.Tag.Frames, "TIT2"); value != "Newer" {
+		t.Errorf("TIT2 is %q, want %q", value, "Newer")
+	}
+}
+
+// A file whose size has changed is left alone too.
+func TestUndoResizedFile(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	path := writeTestFile(t, append(makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Title"))), testAudio...))
+
+	journal := writeTestTitles(t, path, "first", "\x00New")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(testAudio)
+	file.Close()
+	if undoJournalBatch(journal.Name) == nil {
+		t.Errorf("undo restored a file that had changed")
+	}
+}
+
+// A backup whose write can't be added to the index is removed.
+func TestWriteWithoutIndex(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	path := writeTestFile(t, append(makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Title"))), testAudio...))
+	journal, err := openJournal("broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index can't be opened for writing if it's a directory.
+	err = os.MkdirAll(filepath.Join(journal.Dir, JOURNALINDEXNAME), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := itemFromFile(path, Options{ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Tag.Frames[0].Body = []byte("\x00New")
+	if writeItem(item, journal) == nil {
+		t.Errorf("the write was reported as journaled")
+	}
+	names, _ := filepath.Glob(filepath.Join(journal.Dir, "*.tag"))
+	if len(names) > 0 {
+		t.Errorf("backups %v were left in the batch", names)
+	}
+}
+
+// Batches are listed in the order they first wrote a tag, even if one
+// is reused.
+func TestListJournalBatches(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	path := writeTestFile(t, append(makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Title"))), testAudio...))
+
+	writeTestTitles(t, path, "b", "\x00One")
+	writeTestTitles(t, path, "a", "\x00Two")
+	writeTestTitles(t, path, "b", "\x00Three")
+	names, err := listJournalBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !areValuesEqual(names, []string{"b", "a"}) {
+		t.Errorf("batches are %v, want [b a]", names)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+)
+
+
+// findFrameId returns the ID of the frame with the given name in the
+// given version, and whether there is one. The name can be the frame's
+// ID or description in any version, or one of the aliases from
+// `makeFrameAliasMap`, ignoring case. Names from other versions are
+// converted, so one edit document can be used for files with tags of
+// different versions.
+func findFrameId(name string, version int) (string, bool) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	pull := func (part [2]string) (string, string) {
+		return part[0], part[1]
+	}
+
+	// The given version is checked first, so its names win.
+	versions := []int{version}
+	for other := 2; other <= 4; other++ {
+		if other != version {
+			versions = append(versions, other)
+		}
+	}
+
+	for _, other := range versions {
+		for id, description := range makeFrameMap(other, pull) {
+			if ((strings.ToLower(id) == key) || (strings.ToLower(description) == key)) {
+				return convertFrameId(id, other, version)
+			}
+		}
+	}
+
+	if id, present := makeFrameAliasMap(pull)[key]; present {
+		return convertFrameId(id, 4, version)
+	}
+
+	return "", false
+}
+
+// Friendly names for common frames and their v2.4 frame IDs. The
+// names must be lowercase.
+func makeFrameAliasMap(pull func([2]string) (string, string)) map[string]string {
+	parts := [...][2]string{
+		[2]string{"album", "TALB"},
+		[2]string{"album artist", "TPE2"},
+		[2]string{"artist", "TPE1"},
+		[2]string{"bpm", "TBPM"},
+		[2]string{"comment", "COMM"},
+		[2]string{"composer", "TCOM"},
+		[2]string{"disc", "TPOS"},
+		[2]string{"genre", "TCON"},
+		[2]string{"lyrics", "USLT"},
+		[2]string{"title", "TIT2"},
+		[2]string{"track", "TRCK"},
+		[2]string{"year", "TDRC"},
+	}
+
+	return makeMap(parts[:], pull)
+}
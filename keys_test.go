@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+
+func TestFindFrameId(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		want    string
+	}{
+		{"TIT2", 3, "TIT2"},
+		{"tit2", 4, "TIT2"},
+		{"TIT2", 2, "TT2"},
+		{"TT2", 4, "TIT2"},
+		{" Title ", 2, "TT2"},
+		{"year", 4, "TDRC"},
+		{"year", 3, "TYER"},
+		{"Year", 2, "TYE"},
+		{"TYER", 4, "TDRC"},
+		{"comment", 2, "COM"},
+	}
+	for _, test := range tests {
+		id, ok := findFrameId(test.name, test.version)
+		if ((!ok) || (id != test.want)) {
+			t.Errorf("%q in v2.%d: found %q (%v), want %q", test.name, test.version, id, ok, test.want)
+		}
+	}
+
+	for _, name := range []string{"", "nonsense", "TDRL"} {
+		if id, ok := findFrameId(name, 3); ok {
+			t.Errorf("%q in v2.3: found %q", name, id)
+		}
+	}
+}
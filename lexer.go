@@ -14,23 +14,38 @@ func newLexer(reader *bufio.Reader) Lexer {
 	return lexer
 }
 
+// More returns false at the end of the input, or if the input can't
+// be read, in which case the error is left in `Err`.
 func (lexer *Lexer) More() bool {
+	if len(lexer.Queue) > 0 {
+		return true
+	}
 	err := lexer.DiscardWhitespace()
 	if err != nil {
-		panic(err)
+		lexer.Err = err
+		return false
 	}
 	return !lexer.EOF()
 }
 
+// EOF returns true at the end of the input. An error reading the input
+// counts as the end too, and is left in `Err`.
 func (lexer *Lexer) EOF() bool {
 	_, err := lexer.Reader.Peek(1)
 	if ((err != nil) && (err != io.EOF)) {
-		panic(fmt.Sprintf("Error checking for lexer EOF: %s", err))
+		lexer.Err = errors.New(fmt.Sprintf("Error checking for lexer EOF: %s", err))
+		return true
 	}
 	return err == io.EOF
 }
 
 func (lexer *Lexer) Next() (Token, error) {
+	if len(lexer.Queue) > 0 {
+		token := lexer.Queue[0]
+		lexer.Queue = lexer.Queue[1:]
+		return token, nil
+	}
+
 	if !lexer.More() {
 		return lexer.MakeToken(TokenEOF, ""), nil
 	}
@@ -44,7 +59,8 @@ func (lexer *Lexer) Next() (Token, error) {
 	char := string(byte)
 	if char == "[" {
 		// A filepath looks like [/path/to/file].
-		// The closing bracket is optional. 
+		// The closing bracket is optional. The path can be preceded
+		// by a tag version, like [3:/path/to/file].
 		return lexer.ReadFilePath()
 	} else if ((char == "#") || (char == "]")) {
 		err := lexer.IgnoreToEOL()
@@ -53,11 +69,18 @@ func (lexer *Lexer) Next() (Token, error) {
 		} else {
 			return lexer.UnknownToken(), err
 		}
+	} else if char == "-" {
+		// A deletion looks like -frame name, or -* to delete every
+		// frame that isn't given a value.
+		return lexer.ReadFieldDelete()
 	} else if char == ":" {
-		err := lexer.DiscardWhitespace()
-		if err == io.EOF {
-			return lexer.UnknownToken(), nil
-		} else if err != nil {
+		// Only blanks are discarded here: a key followed by a
+		// newline has an empty value.
+		check := func (char string) bool {
+			return ((char == " ") || (char == "\t"))
+		}
+		_, err := lexer.ReadWhile(check)
+		if err != nil {
 			return lexer.UnknownToken(), errors.New(fmt.Sprintf("Error while reading whitespace: %s", err))
 		}
 		return lexer.ReadFieldValue()
@@ -65,7 +88,7 @@ func (lexer *Lexer) Next() (Token, error) {
 		// Make the read byte readable by the reader's next read.
 		err := lexer.Reader.UnreadByte()
 		if err != nil {
-			panic("Unexpected error rewinding reader.")
+			return lexer.UnknownToken(), errors.New(fmt.Sprintf("Error rewinding reader: %s", err))
 		}
 		return lexer.ReadFieldKey()
 	}
@@ -73,6 +96,25 @@ func (lexer *Lexer) Next() (Token, error) {
 
 func (lexer *Lexer) ReadFilePath() (Token, error) {
 	var token Token
+	isDigit := func (char string) bool {
+		return ((char >= "0") && (char <= "9"))
+	}
+	version, err := lexer.ReadWhile(isDigit)
+	if err != nil {
+		return token, err
+	}
+
+	// A path can start with digits too, so they're only a version
+	// if they're followed by a colon.
+	byte, err := lexer.Reader.Peek(1)
+	if ((err != nil) && (err != io.EOF)) {
+		return token, errors.New(fmt.Sprintf("Error peeking byte following file version: %s", err))
+	}
+	is_version := ((version != "") && (string(byte) == ":"))
+	if is_version {
+		lexer.Reader.ReadByte()
+	}
+
 	check := func (char string) bool {
 		return !((char == "]") || (char == "\n"))
 	}
@@ -80,7 +122,12 @@ func (lexer *Lexer) ReadFilePath() (Token, error) {
 	if ((err != nil) && (err != io.EOF)) {
 		return token, err
 	}
-	return lexer.MakeToken(TokenFilePath, path), nil
+
+	if is_version {
+		lexer.Queue = append(lexer.Queue, lexer.MakeToken(TokenFilePath, path))
+		return lexer.MakeToken(TokenFileVersion, version), nil
+	}
+	return lexer.MakeToken(TokenFilePath, version + path), nil
 }
 
 func (lexer *Lexer) ReadFieldKey() (Token, error) {
@@ -103,20 +150,113 @@ func (lexer *Lexer) ReadFieldKey() (Token, error) {
 	}
 }
 
+func (lexer *Lexer) ReadFieldDelete() (Token, error) {
+	var token Token
+	check := func (char string) bool {
+		return !((char == ":") || (char == "\n"))
+	}
+	key, err := lexer.ReadWhile(check)
+	if ((err != nil) && (err != io.EOF)) {
+		return token, err
+	}
+	// Anything following the key, like a colon, is ignored.
+	err = lexer.IgnoreToEOL()
+	if ((err != nil) && (err != io.EOF)) {
+		return token, err
+	}
+	return lexer.MakeToken(TokenFieldDelete, key), nil
+}
+
+// ReadFieldValue reads one of three kinds of value:
+// - a quoted value, in single or double quotes, which can contain
+//   newlines and backslash escapes (\n, \t, \\, \", \')
+// - a block of lines introduced by <<MARKER and ending with a line
+//   that contains only MARKER, like a shell heredoc
+// - an unquoted value, which runs to the end of the line
 func (lexer *Lexer) ReadFieldValue() (Token, error) {
-	byte, err := lexer.Reader.Peek(1)
+	bytes, err := lexer.Reader.Peek(2)
+	if ((err != nil) && (err != io.EOF)) {
+		return lexer.UnknownToken(), err
+	}
+
+	if ((len(bytes) > 0) && ((bytes[0] == '"') || (bytes[0] == '\''))) {
+		return lexer.ReadQuotedValue()
+	} else if string(bytes) == "<<" {
+		return lexer.ReadBlockValue()
+	}
+
+	line, err := lexer.ReadLine()
+	return lexer.MakeToken(TokenFieldValue, line), err
+}
+
+func (lexer *Lexer) ReadQuotedValue() (Token, error) {
+	var str strings.Builder
+	quote, _ := lexer.Reader.ReadByte()
+	for {
+		byte, err := lexer.Reader.ReadByte()
+		if err == io.EOF {
+			return lexer.UnknownToken(), syntaxError("unterminated quoted value %c%s", quote, strings.SplitN(str.String(), "\n", 2)[0])
+		} else if err != nil {
+			return lexer.UnknownToken(), errors.New(fmt.Sprintf("Error while reading quoted value: %s", err))
+		}
+
+		if byte == quote {
+			break
+		} else if byte == '\\' {
+			byte, err = lexer.Reader.ReadByte()
+			if err != nil {
+				return lexer.UnknownToken(), syntaxError("unterminated quoted value %c%s", quote, strings.SplitN(str.String(), "\n", 2)[0])
+			}
+			if byte == 'n' {
+				byte = '\n'
+			} else if byte == 't' {
+				byte = '\t'
+			} else if ((byte != '\\') && (byte != '"') && (byte != '\'')) {
+				// Unrecognized escapes are kept as they are.
+				str.WriteByte('\\')
+			}
+		}
+		str.WriteByte(byte)
+	}
+	return lexer.MakeToken(TokenFieldValue, str.String()), nil
+}
+
+func (lexer *Lexer) ReadBlockValue() (Token, error) {
+	line, err := lexer.ReadLine()
 	if err != nil {
-		return Token{ }, err
+		return lexer.UnknownToken(), err
+	}
+	marker := strings.TrimSpace(line[2:])
+	if marker == "" {
+		return lexer.UnknownToken(), syntaxError("block value is missing its end marker, like <<EOF")
 	}
 
-	char := string(byte)
-	if ((char == "\"") || (char == "'")) {
-		bytes, err := lexer.Reader.ReadBytes(byte[0])
-		return lexer.MakeToken(TokenFieldValue, string(bytes[0: (len(bytes) - 1)])), err
-	} else {
-		bytes, err := lexer.Reader.ReadBytes('\n')
-		return lexer.MakeToken(TokenFieldValue, string(bytes[0: (len(bytes) - 1)])), err
+	var lines []string
+	for {
+		if lexer.EOF() {
+			return lexer.UnknownToken(), syntaxError("block value isn't ended by a line containing '%s'", marker)
+		}
+		line, err := lexer.ReadLine()
+		if err != nil {
+			return lexer.UnknownToken(), err
+		}
+		if strings.TrimSpace(line) == marker {
+			break
+		}
+		lines = append(lines, line)
 	}
+	return lexer.MakeToken(TokenFieldValue, strings.Join(lines, "\n")), nil
+}
+
+// ReadLine reads to the end of the line and returns the line without
+// its line ending. The last line doesn't need to end in a newline.
+func (lexer *Lexer) ReadLine() (string, error) {
+	line, err := lexer.Reader.ReadString('\n')
+	if ((err != nil) && (err != io.EOF)) {
+		return "", errors.New(fmt.Sprintf("Error while reading line: %s", err))
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
 }
 
 func (lexer *Lexer) DiscardWhitespace() error {
@@ -139,10 +279,10 @@ func (lexer *Lexer) ReadWhile(wantChar func(string) bool) (string, error) {
 
 		char := string(byte)
 		if (wantChar(char)) {
-			fmt.Fprintf(&str, char)
+			str.WriteString(char)
 			_, err := lexer.Reader.ReadByte()
 			if err != nil {
-				panic("Unexpected error advancing reader.")
+				return "", errors.New(fmt.Sprintf("Error advancing reader: %s", err))
 			}
 		} else {
 			break
@@ -156,6 +296,12 @@ func (lexer *Lexer) IgnoreToEOL() error {
 	return err
 }
 
+// syntaxError returns an error for input the lexer can't make sense
+// of, as opposed to input it can't read.
+func syntaxError(format string, args ...interface{}) error {
+	return newParseError(ErrLexerSyntax, fmt.Sprintf(format, args...))
+}
+
 func (lexer *Lexer) UnknownToken() Token {
 	return lexer.MakeToken(TokenUnknown, "")
 }
@@ -167,3 +313,27 @@ func (lexer *Lexer) MakeToken(kind TokenType, value string) Token {
 	}
 	return token
 }
+
+// formatFieldValue is the inverse of `ReadFieldValue`. It returns the
+// value in the form that will read back as the same value.
+func formatFieldValue(value string) string {
+	if strings.Contains(value, "\n") {
+		lines := make(map[string]bool)
+		for _, line := range strings.Split(value, "\n") {
+			lines[strings.TrimSpace(line)] = true
+		}
+		marker := "EOF"
+		for n := 1; lines[marker]; n++ {
+			marker = fmt.Sprintf("EOF%d", n)
+		}
+		return "<<" + marker + "\n" + value + "\n" + marker
+	}
+
+	if ((value != strings.TrimSpace(value)) || (strings.HasPrefix(value, "\"")) ||
+		(strings.HasPrefix(value, "'")) || (strings.HasPrefix(value, "<<"))) {
+		escaper := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\t", "\\t")
+		return "\"" + escaper.Replace(value) + "\""
+	}
+
+	return value
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+
+// lexAll returns the tokens in the input up to the end, or up to the
+// first error.
+func lexAll(input string) ([]Token, error) {
+	lexer := newLexer(bufio.NewReader(strings.NewReader(input)))
+	var tokens []Token
+	for lexer.More() {
+		token, err := lexer.Next()
+		if err != nil {
+			return tokens, err
+		}
+		if token.Type == TokenEOF {
+			break
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, lexer.Err
+}
+
+func TestLexer(t *testing.T) {
+	key := func (value string) Token { return Token{Type: TokenFieldKey, Value: value} }
+	value := func (value string) Token { return Token{Type: TokenFieldValue, Value: value} }
+
+	tests := []struct {
+		input string
+		want  []Token
+	}{
+		{"[/a/b.mp3]\nTitle: x\n", []Token{{TokenFilePath, "/a/b.mp3"}, key("Title"), value("x")}},
+		{"[3:/a.mp3]\n", []Token{{TokenFileVersion, "3"}, {TokenFilePath, "/a.mp3"}}},
+		{"[2020 mix.mp3]\n", []Token{{TokenFilePath, "2020 mix.mp3"}}},
+		{"[a.mp3] ignored\n", []Token{{TokenFilePath, "a.mp3"}}},
+		{"# comment\n[a.mp3]\n", []Token{{TokenFilePath, "a.mp3"}}},
+		{"Title:\nArtist: y\n", []Token{key("Title"), value(""), key("Artist"), value("y")}},
+		{"  Title: \t x y \n", []Token{key("Title"), value("x y ")}},
+		{"Title: x\r\n", []Token{key("Title"), value("x")}},
+		{"Title: x", []Token{key("Title"), value("x")}},
+		{"-Title\n-*\n", []Token{{TokenFieldDelete, "Title"}, {TokenFieldDelete, "*"}}},
+		{"-Title: ignored\n", []Token{{TokenFieldDelete, "Title"}}},
+		{`Title: "a\"b\\c\td\ne"` + "\n", []Token{key("Title"), value("a\"b\\c\td\ne")}},
+		{`Title: 'it\'s "x"'` + "\n", []Token{key("Title"), value("it's \"x\"")}},
+		{`Title: "\q"` + "\n", []Token{key("Title"), value(`\q`)}},
+		{"Title: \"two\nlines\"\n", []Token{key("Title"), value("two\nlines")}},
+		{"Lyrics: <<END\nline 1\n  line 2\n\nEND\n", []Token{key("Lyrics"), value("line 1\n  line 2\n")}},
+		{"Lyrics: <<END\r\nx\r\n END \r\nTitle: y\n", []Token{key("Lyrics"), value("x"), key("Title"), value("y")}},
+	}
+
+	for _, test := range tests {
+		tokens, err := lexAll(test.input)
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if len(tokens) != len(test.want) {
+			t.Errorf("%q: tokens are %v, want %v", test.input, tokens, test.want)
+			continue
+		}
+		for i := range tokens {
+			if tokens[i] != test.want[i] {
+				t.Errorf("%q: token %d is %v, want %v", test.input, i, tokens[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestLexerSyntaxErrors(t *testing.T) {
+	inputs := []string{
+		"Title: \"abc\n",
+		"Title: 'abc\\",
+		"Lyrics: <<\nx\n",
+		"Lyrics: <<END\nx\n",
+	}
+	for _, input := range inputs {
+		_, err := lexAll(input)
+		if !errors.Is(err, ErrLexerSyntax) {
+			t.Errorf("%q: error is %v, want a syntax error", input, err)
+		}
+	}
+}
+
+// Values read back as they were formatted.
+func TestFormatFieldValue(t *testing.T) {
+	values := []string{
+		"plain",
+		"",
+		" leading",
+		"trailing\t",
+		"\"quoted\"",
+		"'single'",
+		"<<EOF",
+		"back\\slash",
+		"two\nlines",
+		"EOF\nEOF1\n  indented",
+		"\"quoted\"\n",
+	}
+	for _, want := range values {
+		tokens, err := lexAll("Key: " + formatFieldValue(want) + "\n")
+		if err != nil {
+			t.Errorf("%q: %v", want, err)
+			continue
+		}
+		if ((len(tokens) != 2) || (tokens[1].Value != want)) {
+			t.Errorf("%q: read back as %v", want, tokens)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+
+// The severities of lint findings. Errors break the spec in ways
+// readers may trip on, and warnings in ways they usually don't.
+const (
+	LINTERROR   = "error"
+	LINTWARNING = "warning"
+)
+
+
+// actOnLint checks each file against the ID3v2 spec and prints what it
+// finds, one finding per line, as JSON if the options ask for it. The
+// program exits with status 1 if there are any errors.
+func actOnLint(args []string, options Options) {
+	error_count := 0
+	for _, arg := range args {
+		path, _ := filepath.Abs(arg)
+		for _, finding := range lintFile(path) {
+			if finding.Severity == LINTERROR {
+				error_count++
+			}
+			printLintFinding(finding, options.Json)
+		}
+	}
+	if error_count > 0 {
+		os.Exit(1)
+	}
+}
+
+func printLintFinding(finding LintFinding, as_json bool) {
+	if as_json {
+		line, _ := json.Marshal(finding)
+		fmt.Println(string(line))
+	} else if finding.Offset < 0 {
+		fmt.Printf("%s: %s: %s (%s)\n", finding.Path, finding.Severity, finding.Message, finding.Check)
+	} else {
+		fmt.Printf("%s:%d: %s: %s (%s)\n", finding.Path, finding.Offset, finding.Severity, finding.Message, finding.Check)
+	}
+}
+
+// lintFile checks the tag at the start of the file, the tags its SEEK
+// frames lead to, and the one appended to it, if there is one. Only
+// the tags are read, not the audio between them.
+func lintFile(path string) []LintFinding {
+	var findings []LintFinding
+	report := func (severity string, check string, offset int, id string, format string, args ...interface{}) {
+		finding := LintFinding{Path: path, Offset: offset, Severity: severity, Check: check, FrameId: id, Message: fmt.Sprintf(format, args...)}
+		findings = append(findings, finding)
+	}
+
+	handle, err := os.Open(path)
+	if err != nil {
+		report(LINTERROR, "unreadable", -1, "", "Can't read the file (%s).", err)
+		return findings
+	}
+	defer handle.Close()
+
+	start, err := readFileRange(handle, 0, 3)
+	if err != nil {
+		report(LINTERROR, "unreadable", -1, "", "Can't read the file (%s).", err)
+		return findings
+	}
+
+	// The tags are read tolerantly to find their SEEK frames, so one
+	// is followed even past the problems the checks report.
+	var offsets []int
+	if string(start) == "ID3" {
+		offset := 0
+		for {
+			offsets = append(offsets, offset)
+			item, err := readItemAt(handle, offset, path, Options{Tolerant: true}, V2MAXINFLATESIZE)
+			if err != nil {
+				break
+			}
+			next, found := findSeekTarget(handle, item.Tag)
+			if !found {
+				break
+			}
+			offset = next
+		}
+	}
+	appended, found := findAppendedTag(handle)
+	if ((found) && ((len(offsets) == 0) || (appended > offsets[len(offsets) - 1]))) {
+		offsets = append(offsets, appended)
+	}
+
+	if len(offsets) == 0 {
+		report(LINTERROR, "no-tag", -1, "", "There's no ID3v2 tag.")
+	}
+	for _, offset := range offsets {
+		err = lintTag(handle, offset, report)
+		if err != nil {
+			report(LINTERROR, "unreadable", offset, "", "Can't read the tag (%s).", err)
+		}
+	}
+	return findings
+}
+
+// readFileRange returns `size` bytes of the file from `offset`, or as
+// many as there are before the end of the file.
+func readFileRange(handle *os.File, offset int, size int) ([]byte, error) {
+	available := fileSize(handle) - offset
+	if size > available {
+		size = available
+	}
+	if size <= 0 {
+		return nil, nil
+	}
+	data := make([]byte, size)
+	_, err := handle.ReadAt(data, int64(offset))
+	return data, err
+}
+
+// lintTag checks the tag whose header is `offset` bytes into the file.
+// Offsets in the frames are only exact when the tag isn't
+// unsynchronised as a whole. It only returns an error if the tag can't
+// be read from the file.
+func lintTag(handle *os.File, offset int, report func(string, string, int, string, string, ...interface{})) error {
+	available := fileSize(handle) - offset
+	header_data, err := readFileRange(handle, offset, V2TAGHEADERSIZE)
+	if err != nil {
+		return err
+	}
+	if len(header_data) < V2TAGHEADERSIZE {
+		report(LINTERROR, "truncated-tag", offset, "", "The tag header is cut short.")
+		return nil
+	}
+	version := int(header_data[3])
+	flags := header_data[5]
+
+	if ((version < 2) || (version > 4)) {
+		report(LINTERROR, "unsupported-version", offset, "", "ID3v2.%d isn't a version this checks.", version)
+		return nil
+	}
+	if header_data[4] == 0xFF {
+		report(LINTERROR, "bad-version", offset + 4, "", "The minor version can't be 0xFF.")
+	}
+	if !isSynchsafe(header_data[6:10]) {
+		report(LINTERROR, "non-synchsafe-size", offset + 6, "", "The tag size isn't a synchsafe integer.")
+		return nil
+	}
+
+	unknown_flags := map[int]byte{2: 0x3F, 3: 0x1F, 4: 0x0F}
+	if flags & unknown_flags[version] != 0 {
+		report(LINTWARNING, "unknown-flags", offset + 5, "", "Tag header flags the version doesn't define are set (0x%02X).", flags)
+	}
+	if ((version == 2) && (isBitOn(flags, 6))) {
+		report(LINTWARNING, "compressed-tag", offset + 5, "", "ID3v2.2 tag compression has no defined scheme, so readers skip the tag.")
+	}
+
+	size := synchsafeBytesToInt(header_data[6:10])
+	header := ID3v2TagHeader{Version: version, Size: size, Unsynchronization: isBitOn(flags, 7), Footer: ((version == 4) && (isBitOn(flags, 4)))}
+	end := tagFileSize(header)
+	if end > available {
+		report(LINTERROR, "truncated-tag", offset, "", "The tag is %d bytes, but only %d follow it.", end, available)
+		end = available
+	}
+
+	// Offsets into the tag are from its header.
+	tag, err := readFileRange(handle, offset, end)
+	if err != nil {
+		return err
+	}
+	data_end := V2TAGHEADERSIZE + size
+	if data_end > len(tag) {
+		data_end = len(tag)
+	}
+	data := tag[V2TAGHEADERSIZE:data_end]
+	if ((version < 4) && (header.Unsynchronization)) {
+		data = removeUnsync(data)
+	}
+
+	base := offset + V2TAGHEADERSIZE
+	if ((version > 2) && (isBitOn(flags, 6))) {
+		var extended ID3v2ExtendedHeader
+		if version == 3 {
+			extended, err = v23ReadExtendedHeader(data)
+		} else {
+			extended, err = v24ReadExtendedHeader(data)
+		}
+		if err != nil {
+			report(LINTERROR, "bad-extended-header", base, "", "%s", describeLintError(err))
+			return nil
+		}
+		data = data[extended.Size:]
+		if checkExtendedHeaderCRC(version, extended, data) != nil {
+			report(LINTERROR, "bad-crc", base, "", "The extended header's CRC-32 doesn't match the frames.")
+		}
+		base += extended.Size
+	}
+
+	plain := false
+	if version == 4 {
+		plain = v24HasPlainFrameSizes(data)
+		if plain {
+			report(LINTERROR, "non-synchsafe-size", base, "", "The frame sizes are plain integers, not synchsafe ones.")
+		}
+	}
+	lintFrames(version, data, base, plain, header.Unsynchronization, report)
+
+	if header.Footer {
+		footer := tag[end - V2TAGHEADERSIZE:end]
+		if ((len(footer) < V2TAGHEADERSIZE) || (string(footer[0:3]) != "3DI") || (string(footer[3:]) != string(header_data[3:]))) {
+			report(LINTERROR, "bad-footer", offset + end - V2TAGHEADERSIZE, "", "The footer isn't a copy of the header.")
+		}
+	}
+
+	// A tag whose size is too small is followed by the rest of its
+	// frames rather than by audio. The data after the tag is read as
+	// far as the header found there says its frame goes.
+	after, err := readFileRange(handle, offset + end, V2TAGHEADERSIZE)
+	if err != nil {
+		return err
+	}
+	next, header_size, _ := frameHeaderAt(version, after, plain)
+	if ((header_size > 0) && (next.Size > 0)) {
+		after, err = readFileRange(handle, offset + end, header_size + next.Size)
+		if err != nil {
+			return err
+		}
+	}
+	next, _, ok := frameHeaderAt(version, after, plain)
+	known := makeFrameMap(version, func (part [2]string) (string, string) {
+		return part[0], part[1]
+	})
+	if _, present := known[next.Id]; ((ok) && (present)) {
+		report(LINTERROR, "data-after-tag", offset + end, next.Id, "Frame %s follows the end of the tag, so the tag's size is too small.", next.Id)
+	}
+	return nil
+}
+
+// lintFrames checks the frames in the data, which starts at `base` in
+// the file, and the padding after them.
+func lintFrames(version int, data []byte, base int, plain bool, unsync bool, report func(string, string, int, string, string, ...interface{})) {
+	pull := func (part [2]string) (string, string) {
+		return part[0], part[1]
+	}
+	known := makeFrameMap(version, pull)
+	v23_known := makeFrameMap(3, pull)
+
+	id_size := V23TAGIDSIZE
+	header_size := V23TAGIDSIZE + V23TAGSIZESIZE + V23TAGFLAGSSIZE
+	if version == 2 {
+		id_size = V22TAGIDSIZE
+		header_size = V22TAGIDSIZE + V22TAGSIZESIZE
+	}
+
+	seen := make(map[string]int)
+	pos := 0
+	for pos < len(data) {
+		at := base + pos
+		if data[pos] == 0 {
+			for i, b := range data[pos:] {
+				if b != 0 {
+					report(LINTWARNING, "bad-padding", at + i, "", "The padding holds bytes that aren't zero.")
+					break
+				}
+			}
+			return
+		}
+		if pos + header_size > len(data) {
+			report(LINTERROR, "truncated-frame", at, "", "A frame header is cut short by the end of the tag.")
+			return
+		}
+
+		id := string(data[pos:pos + id_size])
+		if !areBytesValidFrameId(data[pos:pos + id_size]) {
+			report(LINTERROR, "invalid-frame-id", at, "", "%q isn't a frame ID, so the frames after it can't be found.", id)
+			return
+		}
+
+		var size int
+		var flags FrameFlags
+		size_data := data[pos + id_size:pos + id_size + (header_size - id_size) - 2]
+		if version == 2 {
+			size = bytesToInt(data[pos + id_size:pos + header_size])
+		} else if version == 3 {
+			size = bytesToInt(size_data)
+			flags = v23ReadFrameFlags(data[pos + header_size - 2:pos + header_size])
+		} else {
+			if ((!plain) && (!isSynchsafe(size_data))) {
+				report(LINTERROR, "non-synchsafe-size", at + id_size, id, "The size of frame %s isn't a synchsafe integer.", id)
+			}
+			if plain {
+				size = bytesToInt(size_data)
+			} else {
+				size = synchsafeBytesToInt(size_data)
+			}
+			flags = v24ReadFrameFlags(data[pos + header_size - 2:pos + header_size])
+		}
+
+		if size == 0 {
+			report(LINTERROR, "empty-frame", at, id, "Frame %s is empty.", id)
+		}
+		if pos + header_size + size > len(data) {
+			report(LINTERROR, "frame-overflow", at, id, "Frame %s is %d bytes, but only %d are left in the tag.", id, size, len(data) - pos - header_size)
+			return
+		}
+
+		if _, present := known[id]; !present {
+			if ((version == 4) && (v23_known[id] != "")) {
+				report(LINTWARNING, "deprecated-frame", at, id, "Frame %s was dropped in ID3v2.4.", id)
+			} else if ((id[0] != 'X') && (id[0] != 'Y') && (id[0] != 'Z')) {
+				report(LINTERROR, "unknown-frame-id", at, id, "Frame %s isn't defined in ID3v2.%d.", id, version)
+			}
+		}
+
+		frame := ID3v2Frame{Header: ID3v2FrameHeader{Id: id, Size: size, Flags: flags}, Body: data[pos + header_size:pos + header_size + size]}
+		if version == 4 {
+			frame = v24RemoveFrameUnsync(frame, unsync)
+		}
+		formatted, err := readFrameFormat(version, frame, V2MAXINFLATESIZE)
+		if err != nil {
+			report(LINTERROR, "bad-frame-format", at, id, "%s", describeLintError(err))
+		} else if !formatted.Header.Flags.Encrypted {
+			lintFrameBody(version, formatted, at, report)
+
+			key := frameKey(formatted)
+			if first, present := seen[key]; present {
+				if key == id + "\x00" + string(formatted.Body) {
+					report(LINTWARNING, "duplicate-frame", at, id, "Frame %s is a copy of the one at offset %d.", id, first)
+				} else {
+					report(LINTERROR, "duplicate-frame", at, id, "Frame %s can only appear once, but is also at offset %d.", id, first)
+				}
+			} else {
+				seen[key] = at
+			}
+		}
+
+		pos += header_size + size
+	}
+}
+
+// lintFrameBody checks the encoding and strings of frames with text.
+func lintFrameBody(version int, frame ID3v2Frame, at int, report func(string, string, int, string, string, ...interface{})) {
+	id := frame.Header.Id
+	body := frame.Body
+
+	described := ((id == "TXXX") || (id == "WXXX") || (id == "TXX") || (id == "WXX"))
+	has_encoding := ((id[0:1] == "T") || (described) || (isLangTextFrame(id)) || (id == "APIC") || (id == "PIC"))
+	if ((!has_encoding) || (len(body) == 0)) {
+		if (((id == "UFID") || (id == "PRIV") || (id == "UFI")) && (stringLength(body, 0) == len(body))) {
+			report(LINTERROR, "unterminated-string", at, id, "The owner in frame %s isn't terminated.", id)
+		}
+		return
+	}
+
+	encoding := body[0]
+	if encoding > 3 {
+		report(LINTERROR, "bad-encoding", at, id, "Frame %s has text encoding %d, which isn't defined.", id, encoding)
+		return
+	} else if ((version < 4) && (encoding > 1)) {
+		report(LINTERROR, "bad-encoding", at, id, "Frame %s has text encoding %d, which is only defined in ID3v2.4.", id, encoding)
+	}
+
+	// Where the strings that must be terminated are, and what's in
+	// them.
+	var text []byte
+	var what string
+	if described {
+		text = body[1:]
+		what = "description"
+	} else if isLangTextFrame(id) {
+		if len(body) < 4 {
+			report(LINTERROR, "unterminated-string", at, id, "Frame %s is too short to hold a language.", id)
+			return
+		}
+		text = body[4:]
+		what = "description"
+	} else if ((id == "APIC") || (id == "PIC")) {
+		start := 1 + 3
+		if id == "APIC" {
+			start = 1 + stringLength(body[1:], 0) + 1
+			if start > len(body) {
+				report(LINTERROR, "unterminated-string", at, id, "The MIME type in frame %s isn't terminated.", id)
+				return
+			}
+		}
+		if start + 1 > len(body) {
+			report(LINTERROR, "unterminated-string", at, id, "Frame %s is too short to hold a description.", id)
+			return
+		}
+		// The description follows the picture type.
+		text = body[start + 1:]
+		what = "description"
+	}
+	if what != "" {
+		if end, _ := findStringEnd(text, encoding); end < 0 {
+			report(LINTERROR, "unterminated-string", at, id, "The %s in frame %s isn't terminated.", what, id)
+		}
+	}
+	if ((id == "APIC") || (id == "PIC")) {
+		return
+	}
+
+	parts := body[1:]
+	if isLangTextFrame(id) {
+		parts = body[4:]
+	}
+	for len(parts) > 0 {
+		end, width := findStringEnd(parts, encoding)
+		if end < 0 {
+			end, width = len(parts), 0
+		}
+		part := parts[:end]
+		if ((encoding == 1) || (encoding == 2)) {
+			if len(part) % 2 > 0 {
+				report(LINTWARNING, "odd-length-string", at, id, "A UTF-16 string in frame %s has an odd number of bytes.", id)
+			}
+			bom := ((len(part) >= 2) && (((part[0] == 0xFF) && (part[1] == 0xFE)) || ((part[0] == 0xFE) && (part[1] == 0xFF))))
+			if ((encoding == 1) && (len(part) > 0) && (!bom)) {
+				report(LINTWARNING, "missing-bom", at, id, "A UTF-16 string in frame %s doesn't start with a BOM.", id)
+			}
+		} else if ((encoding == 3) && (!utf8.Valid(part))) {
+			report(LINTERROR, "bad-utf8", at, id, "Frame %s holds text that isn't valid UTF-8.", id)
+		}
+		parts = parts[end + width:]
+	}
+}
+
+// describeLintError returns the error's message without the "Error: "
+// a `ParseError` starts with, since the finding says where it is.
+func describeLintError(err error) string {
+	message := strings.TrimPrefix(err.Error(), "Error: ")
+	if len(message) > 0 {
+		message = strings.ToUpper(message[0:1]) + message[1:]
+	}
+	return message
+}
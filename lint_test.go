@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+
+func TestLintFile(t *testing.T) {
+	seek := makeTestTag(4,
+		makeTestFrame(4, "TIT2", nil, []byte("\x00Title")),
+		makeTestFrame(4, "SEEK", nil, intToBytes(2, 4)))
+	bad_encoding := makeTestFrame(4, "TPE1", nil, []byte("\x05Artist"))
+	appended, err := makeTagBytes(ID3v2Tag{
+		Header: ID3v2TagHeader{Version: 4, Footer: true},
+		Frames: []ID3v2Frame{{Header: ID3v2FrameHeader{Id: "TPE1"}, Body: []byte("\x05Artist")}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	title := makeTestFrame(3, "TIT2", nil, []byte("\x00Title"))
+	short := append([]byte{'I', 'D', '3', 3, 0, 0}, synchsafeIntToBytes(len(title))...)
+	short = append(append(short, title...), makeTestFrame(3, "TPE1", nil, []byte("\x00Artist"))...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"clean", makeTestTag(3,
+			makeTestFrame(3, "TIT2", nil, []byte("\x00Title")),
+			makeTestFrame(3, "TXXX", nil, []byte("\x01\xff\xfeA\x00\x00\x00\xff\xfeB\x00"))), nil},
+		{"no tag", []byte{0xff, 0xfb, 0x90, 0x00}, []string{"no-tag"}},
+		{"encoding", makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x03Title"))), []string{"bad-encoding"}},
+		{"empty", makeTestTag(3, makeTestFrame(3, "TIT2", nil, nil)), []string{"empty-frame"}},
+		{"unknown", makeTestTag(3, makeTestFrame(3, "ABCD", nil, []byte("x"))), []string{"unknown-frame-id"}},
+		{"experimental", makeTestTag(3, makeTestFrame(3, "XABC", nil, []byte("x"))), nil},
+		{"deprecated", makeTestTag(4, makeTestFrame(4, "TYER", nil, []byte("\x002006"))), []string{"deprecated-frame"}},
+		{"duplicate", makeTestTag(3,
+			makeTestFrame(3, "TIT2", nil, []byte("\x00A")),
+			makeTestFrame(3, "TIT2", nil, []byte("\x00B"))), []string{"duplicate-frame"}},
+		{"BOM", makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x01T\x00"))), []string{"missing-bom"}},
+		{"UTF-8", makeTestTag(4, makeTestFrame(4, "TIT2", nil, []byte("\x03\xff"))), []string{"bad-utf8"}},
+		{"unterminated", makeTestTag(3, makeTestFrame(3, "TXXX", nil, []byte("\x00Description"))), []string{"unterminated-string"}},
+		{"overflow", makeTestTag(3, []byte("TIT2\x00\x00\x00\x64\x00\x00\x00Title")), []string{"frame-overflow"}},
+		{"SEEK", append(append(seek, testAudio...), makeTestTag(4, bad_encoding)...), []string{"bad-encoding"}},
+		{"appended", append(append([]byte(nil), testAudio...), appended...), []string{"bad-encoding"}},
+		{"data after tag", append(short, testAudio...), []string{"data-after-tag"}},
+	}
+
+	for _, test := range tests {
+		var checks []string
+		for _, finding := range lintFile(writeTestFile(t, test.data)) {
+			checks = append(checks, finding.Check)
+		}
+		if !areValuesEqual(checks, test.want) {
+			t.Errorf("%s: findings are %v, want %v", test.name, checks, test.want)
+		}
+	}
+}
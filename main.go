@@ -7,12 +7,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 
 func main() {
 	// The first argument is the program name.
-	has_args := len(os.Args) > 1
+	options, args := parseArgs(os.Args[1:])
+	has_args := len(args) > 0
 	has_data := !isFileEmpty(os.Stdin)
 
 	if (!(has_args || has_data)) {
@@ -20,39 +23,112 @@ func main() {
 		return
 	}
 
+	if ((has_args) && (args[0] == "undo")) {
+		actOnUndo(args[1:])
+		return
+	} else if ((has_args) && (args[0] == "edit")) {
+		actOnEdit(args[1:], options)
+		return
+	} else if ((has_args) && (args[0] == "charset")) {
+		actOnCharset(args[1:], options)
+		return
+	} else if ((has_args) && (args[0] == "lint")) {
+		actOnLint(args[1:], options)
+		return
+	}
+
 	if has_args {
-		actOnArgs(os.Args[1:])
+		actOnArgs(args, options)
 	}
 
 	if has_data {
-		actOnStdin()
+		actOnStdin(options)
 	}
 }
 
-func actOnArgs(args []string) {
-	x := len(args) - 1
+// parseArgs separates the flag arguments from the others, and returns
+// the options set by the flags along with the other arguments.
+func parseArgs(args []string) (Options, []string) {
+	options := Options{ }
+	var rest []string
 	for _, arg := range args {
-		if (arg[0] == '-') {
-			fmt.Printf("FLAG ARGUMENT '%v'\n", arg)
-		} else {
-			item, err := itemFromFile(arg)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v", err)
-				continue
+		if ((len(arg) > 1) && (arg[0] == '-')) {
+			if ((arg == "-n") || (arg == "--dry-run")) {
+				options.DryRun = true
+			} else if strings.HasPrefix(arg, "--separator=") {
+				options.Separator = strings.TrimPrefix(arg, "--separator=")
+			} else if strings.HasPrefix(arg, "--v23-separator=") {
+				options.V23Separator = strings.TrimPrefix(arg, "--v23-separator=")
+			} else if strings.HasPrefix(arg, "--charset=") {
+				charset, present := canonicalCharset(strings.TrimPrefix(arg, "--charset="))
+				if !present {
+					fmt.Fprintf(os.Stderr, "Unrecognized charset in '%v'.\n", arg)
+				} else {
+					options.Charset = charset
+				}
+			} else if arg == "--json" {
+				options.Json = true
+			} else if arg == "--fix" {
+				options.FixCharset = true
+			} else if arg == "--each-tag" {
+				options.EachTag = true
+			} else if arg == "--compress" {
+				options.Compress = true
+			} else if strings.HasPrefix(arg, "--max-inflate=") {
+				size, err := strconv.Atoi(strings.TrimPrefix(arg, "--max-inflate="))
+				if ((err != nil) || (size <= 0)) {
+					fmt.Fprintf(os.Stderr, "Unrecognized size in '%v'.\n", arg)
+				} else {
+					options.MaxInflate = size
+				}
+			} else if arg == "--force" {
+				options.Force = true
+			} else if arg == "--unsync" {
+				options.Unsync = true
+			} else if arg == "--tolerant" {
+				options.Tolerant = true
+			} else if strings.HasPrefix(arg, "--batch=") {
+				options.Batch = strings.TrimPrefix(arg, "--batch=")
+			} else {
+				fmt.Fprintf(os.Stderr, "Unrecognized flag '%v'.\n", arg)
 			}
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return options, rest
+}
 
-			printItemData(item)
-			if x > 0 {
-				fmt.Println()
-			}
+func actOnArgs(args []string, options Options) {
+	x := len(args) - 1
+	for _, arg := range args {
+		item, err := itemFromFile(arg, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+
+		if options.EachTag {
+			printItemTags(os.Stdout, item, options.Separator)
+		} else {
+			printItemData(os.Stdout, item, options.Separator)
+		}
+		if item.Diagnostics != nil {
+			printDiagnostics(os.Stdout, item.Diagnostics)
+		}
+		if x > 0 {
+			fmt.Println()
 		}
 		x--
 	}
 }
 
-func itemFromFile(file_name string) (*Item, error) {
-	var item *Item
-
+// itemFromFile reads the file's tags: the one at the start of the
+// file, the ones its SEEK frames lead to, and one appended to the end
+// of it. If the options ask for it, the frames are read with
+// `readFramesTolerantly`. Encoding-0 text is read as the charset the
+// options or the file's directory give.
+func itemFromFile(file_name string, options Options) (*Item, error) {
 	path, err := filepath.Abs(file_name)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("File '%s' appears not to exist (%v).", path, err))
@@ -64,41 +140,168 @@ func itemFromFile(file_name string) (*Item, error) {
 		return nil, errors.New(fmt.Sprintf("Can't open file '%s' (%s).", path, err))
 	}
 
-	file_reader := bufio.NewReader(handle)
+	max_inflate := options.MaxInflate
+	if max_inflate <= 0 {
+		max_inflate = V2MAXINFLATESIZE
+	}
+
+	var items []*Item
+	item, err := readItemAt(handle, 0, path, options, max_inflate)
+	if err == nil {
+		items = append(items, item)
+	} else if !errors.Is(err, ErrNoTag) {
+		return nil, withPath(err, path)
+	}
+
+	// A SEEK frame that leads nowhere is ignored, since the tags
+	// before it can still be read. So is one that leads to a tag that
+	// can't be read, or doesn't fit in the file even when read
+	// tolerantly, which is likely "ID3" turning up in the audio.
+	for len(items) > 0 {
+		last := items[len(items) - 1]
+		offset, found := findSeekTarget(handle, last.Tag)
+		if !found {
+			break
+		}
+		item, err = readItemAt(handle, offset, path, options, max_inflate)
+		if ((err == nil) && (tagEnd(item.Tag) > fileSize(handle))) {
+			err = withOffset(newTruncatedError(tagFileSize(item.Tag.Header), fileSize(handle) - offset), offset)
+		}
+		if err != nil {
+			if last.Diagnostics != nil {
+				problem := fmt.Sprintf("Ignored the tag the SEEK frame leads to at offset %d (%v).", offset, err)
+				last.Diagnostics.Problems = append(last.Diagnostics.Problems, problem)
+			}
+			break
+		}
+		items = append(items, item)
+	}
+
+	// The appended tag may be one that was found already, or a tag
+	// with a footer that fills the file.
+	offset, found := findAppendedTag(handle)
+	if ((found) && ((len(items) == 0) || (offset >= tagEnd(items[len(items) - 1].Tag)))) {
+		item, err = readItemAt(handle, offset, path, options, max_inflate)
+		if err != nil {
+			return nil, withPath(err, path)
+		}
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		return nil, withPath(newParseError(ErrNoTag, ""), path)
+	}
+
+	charset, err := charsetForFile(path, options)
+	if err != nil {
+		return nil, err
+	}
+	item = mergeItems(items)
+	item.Recoded = recodeTag(&item.Tag, charset)
+	for i := range item.Tags {
+		recodeTag(&item.Tags[i], charset)
+	}
+	return item, nil
+}
+
+// readItemAt reads the tag whose header is `offset` bytes into the
+// file.
+func readItemAt(handle *os.File, offset int, path string, options Options, max_inflate int) (*Item, error) {
+	available := fileSize(handle) - offset
+	file_reader := bufio.NewReader(io.NewSectionReader(handle, int64(offset), int64(available)))
 
 	tag_header, header_data, err := readV2TagHeader(file_reader)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("ID3 tag not present in file '%s'.\n", path))
+		return nil, withBaseOffset(err, offset)
 	}
 
 	// Update the reader so it will return EOF at the end of the tag.
 	file_reader = bufio.NewReader(io.LimitReader(file_reader, int64(tag_header.Size)))
 
-	if tag_header.Version == 2 {
-		item = v22MakeItem(path, file_reader)
-	} else if tag_header.Version == 3 {
-		item = v23MakeItem(path, file_reader)
-	} else if tag_header.Version == 4 {
-		item = v24MakeItem(path, file_reader)
-	} else {
-		return nil, errors.New(fmt.Sprintf("Unrecognized tag version (%d).", tag_header.Version))
+	item, err := makeItem(tag_header.Version, path, file_reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Tolerant {
+		item.FillTagHeader(&tag_header, header_data)
+		item.Tag.Header = tag_header
+		item.Tag.Offset = offset
+		err = readFramesTolerantly(item, file_reader, max_inflate)
+		moveDiagnostics(item.Diagnostics, offset)
+		return item, err
+	}
+
+	err = fillItemTag(item, tag_header, header_data, max_inflate)
+	if err != nil {
+		return nil, withBaseOffset(err, offset)
+	}
+	item.Tag.Offset = offset
+
+	// A tag can end in padding, which the frame reader stops at, so
+	// a file cut short there is only noticed by its size.
+	if available < tagFileSize(tag_header) {
+		return nil, withOffset(newTruncatedError(tagFileSize(tag_header), available), offset)
 	}
-	fillItemTag(item, tag_header, header_data)
 
 	return item, nil
 }
 
-func actOnStdin() {
+func makeItem(version int, path string, reader *bufio.Reader) (*Item, error) {
+	if version == 2 {
+		return v22MakeItem(path, reader), nil
+	} else if version == 3 {
+		return v23MakeItem(path, reader), nil
+	} else if version == 4 {
+		return v24MakeItem(path, reader), nil
+	}
+	return nil, newParseError(ErrUnsupportedVersion, fmt.Sprintf("ID3v2.%d", version))
+}
+
+func actOnStdin(options Options) {
 	lexer := newLexer(bufio.NewReader(os.Stdin))
-	for lexer.More() {
-		token, err := lexer.Next()
+	edits, err := readFileEdits(&lexer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	applyFileEdits(edits, options)
+}
+
+// applyFileEdits applies each of the edits, or previews them if the
+// options call for a dry run.
+func applyFileEdits(edits []FileEdit, options Options) {
+	journal, err := openJournal(options.Batch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	for _, edit := range edits {
+		if options.DryRun {
+			err := previewFileEdit(edit, options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			continue
+		}
+
+		changes, err := applyFileEdit(edit, journal, options)
 		if err != nil {
-			panic(fmt.Sprintf("Error getting lexer's next token: %s", err))
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		if len(changes) > 0 {
+			fmt.Printf("Updated '%s' (%d changes).\n", edit.Path, len(changes))
 		}
-		fmt.Printf("Got token: %v\n", token)
 	}
 }
 
 func printUsage(program_name string) {
-	fmt.Printf("Usage: %s [path(s) to mp3 file]\n", program_name)
+	fmt.Printf("Usage: %s [--tolerant] [--max-inflate=bytes] [--each-tag] [--separator=text] [--charset=name] [path(s) to mp3 file]\n", program_name)
+	fmt.Printf("       %s [--dry-run] [--batch=name] [--unsync] [--force] [--compress] [--separator=text] [--v23-separator=text] < edits\n", program_name)
+	fmt.Printf("       %s edit [--dry-run] [--batch=name] [--unsync] [--force] [--compress] [--separator=text] [--v23-separator=text] [path(s) to mp3 file]\n", program_name)
+	fmt.Printf("       %s undo [number of batches | batch name]\n", program_name)
+	fmt.Printf("       %s charset [--charset=name] [--fix] [--dry-run] [path(s) to mp3 file]\n", program_name)
+	fmt.Printf("       %s lint [--json] [path(s) to mp3 file]\n", program_name)
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+
+// readFramesTolerantly reads the item's frames like `ReadFrames`, but
+// when it meets a frame that doesn't fit in the tag, or data that's
+// neither a frame nor padding, it skips ahead to the next plausible
+// frame header instead of stopping. The frames it finds that way, and
+// the data it skips, are reported in the item's `Diagnostics`.
+func readFramesTolerantly(item *Item, reader io.Reader, max_inflate int) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	diagnostics := Diagnostics{Scanned: true}
+	version := item.Tag.Header.Version
+	if ((version < 4) && (item.Tag.Header.Unsynchronization)) {
+		data = removeUnsync(data)
+	}
+
+	// An extended header that can't be read is left to be skipped
+	// like any other data that isn't a frame.
+	offset := V2TAGHEADERSIZE
+	if ((version > 2) && (item.Tag.Header.Extended)) {
+		var extended ID3v2ExtendedHeader
+		if version == 3 {
+			extended, err = v23ReadExtendedHeader(data)
+		} else {
+			extended, err = v24ReadExtendedHeader(data)
+		}
+		if err == nil {
+			item.Tag.ExtendedHeader = &extended
+			data = data[extended.Size:]
+			offset += extended.Size
+			err = checkExtendedHeaderCRC(version, extended, data)
+		}
+		if err != nil {
+			diagnostics.Problems = append(diagnostics.Problems, err.Error())
+		}
+	}
+	if version == 4 {
+		item.Tag.PlainFrameSizes = v24HasPlainFrameSizes(data)
+	}
+	known := makeFrameMap(version, func (part [2]string) (string, string) {
+		return part[0], part[1]
+	})
+
+	plain := item.Tag.PlainFrameSizes
+	var frames []ID3v2Frame
+	pos := 0
+	for pos < len(data) {
+		if ((data[pos] == 0) && (len(bytes.Trim(data[pos:], "\x00")) == 0)) {
+			break
+		}
+
+		header, header_size, ok := frameHeaderAt(version, data[pos:], plain)
+		end := pos + header_size + header.Size
+		if ((ok) && (!isFrameFollowed(version, data[end:], plain))) {
+			// If the frame's size is wrong, there will usually be a
+			// frame inside it. If not, the data after it is corrupt,
+			// and is skipped on the next pass.
+			next, _, _, found := scanForFrame(version, data, pos + 1, known, plain)
+			ok = ((!found) || (next >= end))
+		}
+
+		if !ok {
+			next, next_header, next_size, found := scanForFrame(version, data, pos + 1, known, plain)
+			skipped := ByteRange{Start: offset + pos, End: offset + next}
+			diagnostics.Skipped = append(diagnostics.Skipped, skipped)
+			if !found {
+				break
+			}
+			pos = next
+			header = next_header
+			header_size = next_size
+			location := FrameLocation{Id: header.Id, Offset: offset + pos}
+			diagnostics.Recovered = append(diagnostics.Recovered, location)
+		}
+
+		start := pos + header_size
+		body := make([]byte, header.Size)
+		copy(body, data[start:start + header.Size])
+		frame := ID3v2Frame{Header: header, Body: body}
+		if version == 4 {
+			frame = v24RemoveFrameUnsync(frame, item.Tag.Header.Unsynchronization)
+		}
+		// A frame whose format can't be read is kept as it is.
+		formatted, err := readFrameFormat(version, frame, max_inflate)
+		if err != nil {
+			diagnostics.Problems = append(diagnostics.Problems, err.Error())
+		} else {
+			frame = formatted
+		}
+		frames = append(frames, frame)
+		pos = start + header.Size
+	}
+
+	// Frames are decrypted as they are when read strictly. A frame
+	// that can't be decrypted is kept as it is.
+	err = decryptFrames(frames, max_inflate)
+	if err != nil {
+		diagnostics.Problems = append(diagnostics.Problems, err.Error())
+	}
+
+	item.Tag.Frames = frames
+	item.Diagnostics = &diagnostics
+	return nil
+}
+
+// frameHeaderAt reads a frame header from the start of the data. It
+// returns the header, the header's size, and whether the header is
+// plausible: a valid frame ID, with a body that isn't empty and fits
+// in the data.
+func frameHeaderAt(version int, data []byte, plain bool) (ID3v2FrameHeader, int, bool) {
+	var header ID3v2FrameHeader
+	var header_size int
+	var err error
+
+	id_size := V23TAGIDSIZE
+	if version == 2 {
+		id_size = V22TAGIDSIZE
+	}
+	if ((len(data) < id_size) || (!areBytesValidFrameId(data[:id_size]))) {
+		return header, 0, false
+	}
+
+	if version == 2 {
+		header_size = V22TAGIDSIZE + V22TAGSIZESIZE
+	} else if version == 3 {
+		header_size = V23TAGIDSIZE + V23TAGSIZESIZE + V23TAGFLAGSSIZE
+	} else {
+		header_size = V24TAGIDSIZE + V24TAGSIZESIZE + V24TAGFLAGSSIZE
+	}
+	if len(data) < header_size {
+		return header, 0, false
+	}
+
+	// bufio won't make a buffer smaller than 16 bytes.
+	reader := bufio.NewReaderSize(bytes.NewReader(data[:header_size]), 16)
+	if version == 2 {
+		header, err = v22ReadFrameHeader(reader)
+	} else if version == 3 {
+		header, err = v23ReadFrameHeader(reader)
+	} else {
+		if ((!plain) && (!isSynchsafe(data[V24TAGIDSIZE:V24TAGIDSIZE + V24TAGSIZESIZE]))) {
+			return header, 0, false
+		}
+		header, err = v24ReadFrameHeader(reader, plain)
+	}
+
+	ok := ((err == nil) && (header.Size > 0) && (header_size + header.Size <= len(data)))
+	return header, header_size, ok
+}
+
+// scanForFrame returns the position of the first plausible frame in
+// the data at or after `pos`, along with its header and header size.
+// Only frame IDs the version defines are trusted, since otherwise any
+// four capitals would do, and the frame must be followed by another or
+// by padding. If there's no such frame, the position returned is the
+// end of the data.
+func scanForFrame(version int, data []byte, pos int, known map[string]string, plain bool) (int, ID3v2FrameHeader, int, bool) {
+	for ; pos < len(data); pos++ {
+		header, header_size, ok := frameHeaderAt(version, data[pos:], plain)
+		if ok {
+			_, present := known[header.Id]
+			if ((present) && (isFrameFollowed(version, data[pos + header_size + header.Size:], plain))) {
+				return pos, header, header_size, true
+			}
+		}
+	}
+	return len(data), ID3v2FrameHeader{ }, 0, false
+}
+
+// isFrameFollowed returns true if the data following a frame starts
+// with another plausible frame header, or padding, or is empty. A
+// frame whose size is wrong will usually not be followed by any of
+// those.
+func isFrameFollowed(version int, rest []byte, plain bool) bool {
+	if ((len(rest) == 0) || (rest[0] == 0)) {
+		return true
+	}
+	_, _, ok := frameHeaderAt(version, rest, plain)
+	return ok
+}
+
+// addProblem reports a problem that didn't stop the item's frames
+// being read.
+func addProblem(item *Item, err error) {
+	if item.Diagnostics == nil {
+		item.Diagnostics = &Diagnostics{ }
+	}
+	item.Diagnostics.Problems = append(item.Diagnostics.Problems, err.Error())
+}
+
+// moveDiagnostics moves the offsets in the report by `base`, for a tag
+// that isn't at the start of the file.
+func moveDiagnostics(diagnostics *Diagnostics, base int) {
+	for i := range diagnostics.Skipped {
+		diagnostics.Skipped[i].Start += base
+		diagnostics.Skipped[i].End += base
+	}
+	for i := range diagnostics.Recovered {
+		diagnostics.Recovered[i].Offset += base
+	}
+}
+
+// printDiagnostics prints the report as comments, so it can follow
+// the item's frames in an edit document.
+func printDiagnostics(out io.Writer, diagnostics *Diagnostics) {
+	for _, problem := range diagnostics.Problems {
+		fmt.Fprintf(out, "# %s\n", problem)
+	}
+	if !diagnostics.Scanned {
+		return
+	}
+	if ((len(diagnostics.Skipped) == 0) && (len(diagnostics.Recovered) == 0)) {
+		fmt.Fprintln(out, "# No corrupt frames found.")
+		return
+	}
+	for _, skipped := range diagnostics.Skipped {
+		fmt.Fprintf(out, "# Skipped bytes %d-%d (%d bytes).\n", skipped.Start, skipped.End - 1, skipped.End - skipped.Start)
+	}
+	for _, frame := range diagnostics.Recovered {
+		fmt.Fprintf(out, "# Recovered frame %s at offset %d.\n", frame.Id, frame.Offset)
+	}
+}
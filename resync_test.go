@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+
+// A frame with a bad size is skipped, and the frames after it are
+// found again.
+func TestReadFramesTolerantly(t *testing.T) {
+	for _, version := range []int{2, 3, 4} {
+		ids := []string{"TIT2", "TALB", "TPE1"}
+		if version == 2 {
+			ids = []string{"TT2", "TAL", "TP1"}
+		}
+		bad := makeTestFrame(version, ids[1], nil, []byte("\x00Album"))
+		// A size far larger than the body.
+		bad[len(ids[1]) + 2] = 0x7f
+		data := makeTestTag(version,
+			makeTestFrame(version, ids[0], nil, []byte("\x00Title")),
+			bad,
+			makeTestFrame(version, ids[2], nil, []byte("\x00Artist")))
+		path := writeTestFile(t, data)
+
+		_, err := itemFromFile(path, Options{ })
+		if err == nil {
+			t.Errorf("v2.%d: the tag was read strictly", version)
+		}
+		item, err := itemFromFile(path, Options{Tolerant: true})
+		if err != nil {
+			t.Fatalf("v2.%d: %v", version, err)
+		}
+		if ((frameText(item.Tag.Frames, ids[0]) != "Title") || (frameText(item.Tag.Frames, ids[2]) != "Artist")) {
+			t.Errorf("v2.%d: read frames %v", version, item.Tag.Frames)
+		}
+		diagnostics := item.Diagnostics
+		if ((len(diagnostics.Skipped) != 1) || (len(diagnostics.Recovered) != 1) || (diagnostics.Recovered[0].Id != ids[2])) {
+			t.Errorf("v2.%d: diagnostics are %+v", version, *diagnostics)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+
+// The size of an ID3v1 tag, which is always at the very end of a file.
+const V1TAGSIZE = 128
+
+
+// findAppendedTag looks for a v2.4 tag appended to the file, which is
+// found by its footer. The footer is at the end of the file, or just
+// before an ID3v1 tag. It returns where the tag's header is.
+func findAppendedTag(handle *os.File) (int, bool) {
+	end := fileSize(handle)
+
+	v1 := make([]byte, 3)
+	_, err := handle.ReadAt(v1, int64(end - V1TAGSIZE))
+	if ((err == nil) && (string(v1) == "TAG")) {
+		end -= V1TAGSIZE
+	}
+
+	footer := make([]byte, V2TAGHEADERSIZE)
+	_, err = handle.ReadAt(footer, int64(end - V2TAGHEADERSIZE))
+	if ((err != nil) || (string(footer[0:3]) != "3DI") || (!isSynchsafe(footer[6:]))) {
+		return 0, false
+	}
+
+	// The footer is a copy of the header, but for the identifier.
+	start := end - V2TAGHEADERSIZE - synchsafeBytesToInt(footer[6:]) - V2TAGHEADERSIZE
+	header := make([]byte, V2TAGHEADERSIZE)
+	_, err = handle.ReadAt(header, int64(start))
+	if ((start < 0) || (err != nil) || (string(header[0:3]) != "ID3") || (string(header[3:]) != string(footer[3:]))) {
+		return 0, false
+	}
+	return start, true
+}
+
+// findSeekTarget returns where the tag that the tag's SEEK frame leads
+// to is. The frame gives the least number of bytes from the end of the
+// tag to the next tag, which is the first tag header found from there.
+func findSeekTarget(handle *os.File, tag ID3v2Tag) (int, bool) {
+	for _, frame := range tag.Frames {
+		if ((frame.Header.Id == "SEEK") && (len(frame.Body) >= 4) && (isFrameReadable(frame))) {
+			return findTagFrom(handle, tagEnd(tag) + bytesToInt(frame.Body[0:4]))
+		}
+	}
+	return 0, false
+}
+
+// findTagFrom returns where the first v2.4 tag header at or after
+// `pos` in the file is.
+func findTagFrom(handle *os.File, pos int) (int, bool) {
+	size := fileSize(handle)
+	chunk := make([]byte, 64 * 1024)
+	for pos + V2TAGHEADERSIZE <= size {
+		n, _ := handle.ReadAt(chunk, int64(pos))
+		for i := 0; i + V2TAGHEADERSIZE <= n; i++ {
+			if isV2TagHeader(chunk[i:i + V2TAGHEADERSIZE]) {
+				return pos + i, true
+			}
+		}
+		// The chunks overlap so a header can't be split between them.
+		pos += n - V2TAGHEADERSIZE + 1
+	}
+	return 0, false
+}
+
+// isV2TagHeader returns true if the data is a plausible v2.4 tag
+// header, which is as much as can be said of data found in audio.
+func isV2TagHeader(data []byte) bool {
+	return ((string(data[0:3]) == "ID3") && (data[3] == 4) && (data[4] != 0xff) &&
+		(data[5] & 0x0f == 0) && (isSynchsafe(data[6:10])))
+}
+
+// tagEnd returns where the data following the tag starts in the file.
+func tagEnd(tag ID3v2Tag) int {
+	return tag.Offset + tagFileSize(tag.Header)
+}
+
+// mergeItems makes one item of the items read from each of a file's
+// tags, in the order they were read. Its tag is their tags merged,
+// and it's printed as the last tag's version.
+func mergeItems(items []*Item) *Item {
+	item := *items[len(items) - 1]
+	item.Tag = items[0].Tag
+	item.Tags = nil
+	item.Diagnostics = nil
+
+	for i, each := range items {
+		item.Tags = append(item.Tags, each.Tag)
+		if i > 0 {
+			item.Tag = mergeTags(item.Tag, each.Tag)
+		}
+		if each.Diagnostics != nil {
+			if item.Diagnostics == nil {
+				item.Diagnostics = &Diagnostics{ }
+			}
+			item.Diagnostics.Scanned = ((item.Diagnostics.Scanned) || (each.Diagnostics.Scanned))
+			item.Diagnostics.Problems = append(item.Diagnostics.Problems, each.Diagnostics.Problems...)
+			item.Diagnostics.Skipped = append(item.Diagnostics.Skipped, each.Diagnostics.Skipped...)
+			item.Diagnostics.Recovered = append(item.Diagnostics.Recovered, each.Diagnostics.Recovered...)
+		}
+	}
+	return &item
+}
+
+// mergeTags returns the tag made by reading the `later` tag after the
+// `earlier` one. The spec says that if the later tag is an update,
+// which its extended header says, its frames override the earlier
+// tag's corresponding frames. A later tag that isn't an update is
+// taken to hold the rest of the frames, like a tag appended to hold
+// what doesn't fit at the start of the file, so it only adds frames
+// the earlier tag doesn't have. The earlier tag is converted to the
+// later tag's version first.
+func mergeTags(earlier ID3v2Tag, later ID3v2Tag) ID3v2Tag {
+	if earlier.Header.Version != later.Header.Version {
+		earlier, _ = convertTag(earlier, later.Header.Version)
+	}
+
+	merged := later
+	merged.Offset = earlier.Offset
+	merged.PlainFrameSizes = ((earlier.PlainFrameSizes) || (later.PlainFrameSizes))
+	merged.Frames = nil
+
+	update := ((later.ExtendedHeader != nil) && (later.ExtendedHeader.Update))
+	first, second := earlier.Frames, later.Frames
+	if update {
+		first, second = later.Frames, earlier.Frames
+	}
+
+	present := make(map[string]bool)
+	for _, frame := range first {
+		present[frameKey(frame)] = true
+	}
+	if update {
+		merged.Frames = append(merged.Frames, keepFrames(second, present)...)
+		merged.Frames = append(merged.Frames, first...)
+	} else {
+		merged.Frames = append(merged.Frames, first...)
+		merged.Frames = append(merged.Frames, keepFrames(second, present)...)
+	}
+	return merged
+}
+
+// keepFrames returns the frames whose keys aren't present.
+func keepFrames(frames []ID3v2Frame, present map[string]bool) []ID3v2Frame {
+	var kept []ID3v2Frame
+	for _, frame := range frames {
+		if !present[frameKey(frame)] {
+			kept = append(kept, frame)
+		}
+	}
+	return kept
+}
+
+// frameKey returns what tells a frame apart from the others in its
+// tag. Most frames may appear once in a tag, so their ID does. Some
+// may appear once for each description, language or owner, and the
+// rest any number of times, so only an identical frame is the same.
+func frameKey(frame ID3v2Frame) string {
+	id := frame.Header.Id
+	body := frame.Body
+	whole := id + "\x00" + string(body)
+
+	if ((len(body) == 0) || (!isFrameReadable(frame))) {
+		return whole
+	}
+
+	if ((id == "TXXX") || (id == "WXXX") || (id == "TXX") || (id == "WXX")) {
+		// The description follows the encoding byte.
+		return id + "\x00" + string(body[0:1 + stringLength(body[1:], body[0])])
+	} else if isLangTextFrame(id) {
+		lang, description, _ := parseLangText(body)
+		return id + "\x00" + lang + "\x00" + description
+	} else if ((id == "UFID") || (id == "PRIV") || (id == "POPM")) {
+		// The owner or email is first, in ISO-8859-1.
+		return id + "\x00" + string(body[0:stringLength(body, 0)])
+	} else if id == "APIC" {
+		// The encoding, MIME type, picture type and description.
+		mime_end := 1 + stringLength(body[1:], 0) + 1
+		if mime_end >= len(body) {
+			return whole
+		}
+		return id + "\x00" + string(body[mime_end:mime_end + 1 + stringLength(body[mime_end + 1:], body[0])])
+	} else if ((id == "WCOM") || (id == "WOAR") || (id == "WCM") || (id == "WAR")) {
+		return whole
+	} else if ((id[0:1] == "T") || (id[0:1] == "W")) {
+		return id
+	}
+
+	unique := map[string]bool{
+		"MCDI": true, "ETCO": true, "MLLT": true, "SYTC": true,
+		"RVRB": true, "PCNT": true, "RBUF": true, "POSS": true,
+		"OWNE": true, "SEEK": true, "ASPI": true,
+	}
+	if unique[id] {
+		return id
+	}
+	return whole
+}
+
+// stringLength returns the length of the first string in the data,
+// which is all of it if there's no terminator.
+func stringLength(data []byte, encoding byte) int {
+	end, _ := findStringEnd(data, encoding)
+	if end < 0 {
+		return len(data)
+	}
+	return end
+}
+
+// printTagLocations prints where each of the item's tags is, if there
+// is more to say than that there's one at the start of the file.
+func printTagLocations(out io.Writer, item *Item) {
+	if ((len(item.Tags) == 1) && (item.Tags[0].Offset == 0)) {
+		return
+	}
+	for _, tag := range item.Tags {
+		fmt.Fprintf(out, "# %s\n", describeTagLocation(tag))
+	}
+}
+
+// printItemTags prints each of the item's tags on its own, as it is
+// in the file, rather than the tags merged.
+func printItemTags(out io.Writer, item *Item, separator string) {
+	for i, tag := range item.Tags {
+		each, err := makeItem(tag.Header.Version, item.Path, nil)
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "[%v:%v]\n", tag.Header.Version, item.Path)
+		fmt.Fprintf(out, "# %s\n", describeTagLocation(tag))
+		each.PrintFrames(out, tag.Frames, separator)
+	}
+}
+
+func describeTagLocation(tag ID3v2Tag) string {
+	place := "prepended"
+	if tag.Offset > 0 {
+		place = "appended"
+	}
+	if ((tag.ExtendedHeader != nil) && (tag.ExtendedHeader.Update)) {
+		place += ", update"
+	}
+	return fmt.Sprintf("ID3v2.%d tag at offset %d (%d bytes, %s).", tag.Header.Version, tag.Offset, tagFileSize(tag.Header), place)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+)
+
+
+// A SEEK frame leading to "ID3" in the audio, which isn't a tag that
+// can be read, is ignored.
+func TestSeekToUnreadableTag(t *testing.T) {
+	data := makeTestTag(4,
+		makeTestFrame(4, "TIT2", nil, []byte("\x00Title")),
+		makeTestFrame(4, "SEEK", nil, intToBytes(8, 4)))
+	audio := make([]byte, 64)
+	// A header whose size runs past the end of the file.
+	copy(audio[20:], append([]byte("ID3\x04\x00\x00"), synchsafeIntToBytes(4096)...))
+	path := writeTestFile(t, append(data, audio...))
+
+	for _, tolerant := range []bool{false, true} {
+		item, err := itemFromFile(path, Options{Tolerant: tolerant})
+		if err != nil {
+			t.Fatalf("tolerant=%v: %v", tolerant, err)
+		}
+		if len(item.Tags) != 1 {
+			t.Errorf("tolerant=%v: read %d tags, want 1", tolerant, len(item.Tags))
+		}
+		if value := frameText(item.Tag.Frames, "TIT2"); value != "Title" {
+			t.Errorf("tolerant=%v: TIT2 is %q, want %q", tolerant, value, "Title")
+		}
+	}
+}
+
+// A later tag only adds the frames the earlier one doesn't have,
+// unless it's an update, in which case its frames win.
+func TestMergeTags(t *testing.T) {
+	makeTag := func (version int, frames ...[2]string) ID3v2Tag {
+		tag := ID3v2Tag{Header: ID3v2TagHeader{Version: version}}
+		for _, frame := range frames {
+			tag.Frames = append(tag.Frames, ID3v2Frame{Header: ID3v2FrameHeader{Id: frame[0]}, Body: []byte(frame[1])})
+		}
+		return tag
+	}
+	earlier := makeTag(3, [2]string{"TIT2", "\x00Old"}, [2]string{"TALB", "\x00Album"},
+		[2]string{"COMM", "\x00eng\x00Old"}, [2]string{"TXXX", "\x00A\x00Old"})
+	later := makeTag(4, [2]string{"TIT2", "\x00New"}, [2]string{"TPE1", "\x00Artist"},
+		[2]string{"COMM", "\x00eng\x00New"}, [2]string{"TXXX", "\x00B\x00New"})
+
+	tests := []struct {
+		update bool
+		want   []string
+	}{
+		{false, []string{"TIT2 Old", "TALB Album", "COMM eng\x00Old", "TXXX A\x00Old", "TPE1 Artist", "TXXX B\x00New"}},
+		{true, []string{"TALB Album", "TXXX A\x00Old", "TIT2 New", "TPE1 Artist", "COMM eng\x00New", "TXXX B\x00New"}},
+	}
+	for _, test := range tests {
+		later.ExtendedHeader = &ID3v2ExtendedHeader{Update: test.update}
+		merged := mergeTags(earlier, later)
+		if merged.Header.Version != 4 {
+			t.Errorf("update=%v: merged as v2.%d", test.update, merged.Header.Version)
+		}
+		var frames []string
+		for _, frame := range merged.Frames {
+			frames = append(frames, frame.Header.Id + " " + string(frame.Body[1:]))
+		}
+		if !areValuesEqual(frames, test.want) {
+			t.Errorf("update=%v: merged frames are %q, want %q", test.update, frames, test.want)
+		}
+	}
+}
+
+// A v2.4 tag appended to the file is found by its footer.
+func TestReadAppendedTag(t *testing.T) {
+	appended := ID3v2Tag{Header: ID3v2TagHeader{Version: 4, Footer: true}}
+	appended.Frames = []ID3v2Frame{
+		ID3v2Frame{Header: ID3v2FrameHeader{Id: "TIT2"}, Body: []byte("\x00New")},
+		ID3v2Frame{Header: ID3v2FrameHeader{Id: "TPE1"}, Body: []byte("\x00Artist")},
+	}
+	tag, err := makeTagBytes(appended, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prepended := range []bool{false, true} {
+		var data []byte
+		if prepended {
+			data = makeTestTag(3, makeTestFrame(3, "TIT2", nil, []byte("\x00Old")))
+		}
+		data = append(append(data, testAudio...), tag...)
+		item, err := itemFromFile(writeTestFile(t, data), Options{ })
+		if err != nil {
+			t.Fatalf("prepended=%v: %v", prepended, err)
+		}
+
+		want := "New"
+		if prepended {
+			want = "Old"
+		}
+		if value := frameText(item.Tag.Frames, "TIT2"); value != want {
+			t.Errorf("prepended=%v: TIT2 is %q, want %q", prepended, value, want)
+		}
+		if value := frameText(item.Tag.Frames, "TPE1"); value != "Artist" {
+			t.Errorf("prepended=%v: TPE1 is %q, want %q", prepended, value, "Artist")
+		}
+	}
+}
+
+// A SEEK frame leads to the next tag, which adds the frames the first
+// one doesn't have.
+func TestFollowSeekFrame(t *testing.T) {
+	first := makeTestTag(4,
+		makeTestFrame(4, "TIT2", nil, []byte("\x00Title")),
+		makeTestFrame(4, "SEEK", nil, intToBytes(2, 4)))
+	second := makeTestTag(4, makeTestFrame(4, "TPE1", nil, []byte("\x00Artist")))
+	path := writeTestFile(t, append(append(first, testAudio...), second...))
+
+	item, err := itemFromFile(path, Options{ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(item.Tags) != 2 {
+		t.Errorf("read %d tags, want 2", len(item.Tags))
+	}
+	if value := frameText(item.Tag.Frames, "TPE1"); value != "Artist" {
+		t.Errorf("TPE1 is %q, want %q", value, "Artist")
+	}
+}
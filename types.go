@@ -2,12 +2,61 @@ package main
 
 import (
 	"bufio"
+	"io"
 )
 
 
+// Options are set by the program's flag arguments.
+type Options struct {
+	// Show the changes an edit document would make without making them.
+	DryRun bool
+	// The name of the journal batch to record tag backups in.
+	Batch  string
+	// Read past corrupt frames instead of failing, and report what
+	// was skipped.
+	Tolerant bool
+	// Apply unsynchronisation to tags that need it when writing them.
+	// Tags that were unsynchronised when read always are.
+	Unsync   bool
+	// Change frames marked read-only.
+	Force    bool
+	// Compress large frames when writing them.
+	Compress bool
+	// Print each of a file's tags rather than the tags merged.
+	EachTag  bool
+	// Print a frame's values on one line joined with this, and split
+	// the values in edit documents with it. Empty means each value is
+	// on a line of its own.
+	Separator    string
+	// What to join the values of v2.2 and v2.3 text frames with when
+	// writing them. Empty means "/".
+	V23Separator string
+	// The charset to read encoding-0 text as, instead of ISO-8859-1.
+	// Empty means the one the file's directory gives, if any. See
+	// `charsetForFile`.
+	Charset      string
+	// Write the tag when text was read as a charset, so the text is
+	// stored as Unicode, even if nothing else changes.
+	FixCharset   bool
+	// Print lint findings as JSON.
+	Json         bool
+	// The largest a compressed frame can be once inflated. 0 means
+	// `V2MAXINFLATESIZE`.
+	MaxInflate int
+}
+
 type ID3v2Tag struct {
 	Header ID3v2TagHeader
 	Frames []ID3v2Frame
+	// Nil unless the tag header's Extended flag is set.
+	ExtendedHeader *ID3v2ExtendedHeader
+	// Whether the frame sizes of a v2.4 tag were read as plain
+	// integers, as some taggers wrongly write them, rather than as
+	// synchsafe ones. They're always written as synchsafe integers,
+	// so writing the tag fixes it.
+	PlainFrameSizes bool
+	// Where the tag's header is in the file.
+	Offset int
 }
 
 type ID3v2TagHeader struct {
@@ -29,17 +78,175 @@ type ID3v2Frame struct {
 type ID3v2FrameHeader struct {
 	Id    string
 	Size  int
-	// This could be a struct of booleans or just add booleans to
-	// this struct like with the TagHeader.  @TODO
-	Flags []byte
+	Flags FrameFlags
+	// The data format flags add to the start of a frame's body. See
+	// `readFrameFormat`.
+	GroupId          byte
+	EncryptionMethod byte
+	DataLength       int
+	// Whether an encrypted frame's body has been decrypted. If so,
+	// it's encrypted again when it's written. See `decryptFrames`.
+	Decrypted        bool
+}
+
+// An EncryptionMethod is registered by an ENCR frame. Encrypted frames
+// give the symbol of the method they're encrypted with.
+type EncryptionMethod struct {
+	// Usually a URL or an email address.
+	Owner  string
+	Symbol byte
+	Data   []byte
+}
+
+// A FrameCipher decrypts and encrypts frame bodies for the owner it's
+// registered for with `registerFrameCipher`. It's given the owner's
+// key from the keyring.
+type FrameCipher interface {
+	Decrypt(method EncryptionMethod, key []byte, data []byte) ([]byte, error)
+	Encrypt(method EncryptionMethod, key []byte, data []byte) ([]byte, error)
+}
+
+// The flags of a v2.3 or v2.4 frame. v2.2 frames have none.
+type FrameFlags struct {
+	// Status flags. The first two say the frame should be dropped
+	// by a program that doesn't know it when the tag or the rest of
+	// the file is changed.
+	DiscardOnTagAlter  bool
+	DiscardOnFileAlter bool
+	ReadOnly           bool
+	// Format flags, which say how the frame's body is stored. The
+	// last two are v2.4 only.
+	Compressed         bool
+	Encrypted          bool
+	Grouped            bool
+	Unsynchronised     bool
+	HasDataLength      bool
 }
 
 type Item struct {
 	Path          string
+	// The file's tags merged into one. See `mergeTags`.
 	Tag           ID3v2Tag
+	// Each tag in the file, in the order they were read.
+	Tags          []ID3v2Tag
+	// Set when the tag has been converted from the file's version.
+	Converted     bool
+	// The number of frames whose text was read as a legacy charset.
+	// See `recodeTag`.
+	Recoded       int
+	// Set when the tag was read tolerantly, or had problems that
+	// didn't stop it being read. See `readFramesTolerantly`.
+	Diagnostics   *Diagnostics
 	FillTagHeader func(*ID3v2TagHeader, []byte)
-	ReadFrames    func() []ID3v2Frame
-	PrintFrames   func([]ID3v2Frame)
+	ReadFrames    func() ([]ID3v2Frame, error)
+	PrintFrames   func(io.Writer, []ID3v2Frame, string)
+}
+
+// The extended header follows the tag header in v2.3 and v2.4 tags.
+// It isn't written back: its CRC would have to be updated, and none
+// of it is needed to read a tag.
+type ID3v2ExtendedHeader struct {
+	// The number of bytes the extended header takes up in the tag.
+	Size         int
+	HasCRC       bool
+	// A CRC-32 of the frames in v2.3, or of everything after the
+	// extended header in v2.4.
+	CRC          uint32
+	// v2.3 only: the size of the padding after the frames.
+	PaddingSize  int
+	// v2.4 only: whether the tag updates an earlier tag in the file.
+	Update       bool
+	// v2.4 only.
+	HasRestrictions bool
+	Restrictions TagRestrictions
+}
+
+// TagRestrictions holds the codes of the restrictions a v2.4 tag's
+// extended header can place on the tag. See `describeTagRestrictions`.
+type TagRestrictions struct {
+	TagSize       int
+	TextEncoding  int
+	TextSize      int
+	ImageEncoding int
+	ImageSize     int
+}
+
+// Diagnostics reports what the tolerant frame reader found in a tag,
+// and problems the strict one read past. Offsets are from the start
+// of the file.
+type Diagnostics struct {
+	// Set when the tag was scanned for corrupt frames.
+	Scanned   bool
+	// The frames found by scanning past corrupt data.
+	Recovered []FrameLocation
+	// The data that couldn't be read as frames or padding.
+	Skipped   []ByteRange
+	// Problems that didn't stop the frames being read, like a bad
+	// CRC.
+	Problems  []string
+}
+
+type FrameLocation struct {
+	Id     string
+	Offset int
+}
+
+// A ByteRange runs from Start up to, but not including, End.
+type ByteRange struct {
+	Start int
+	End   int
+}
+
+// A FileEdit collects the fields given for one file in an edit
+// document, in the order they were given.
+type FileEdit struct {
+	Path    string
+	// The version to write the tag as. 0 keeps the file's version.
+	Version int
+	Fields  []FieldEdit
+	// The names of frames to remove from the tag.
+	Deletes []string
+	// Set to remove every frame that isn't given in `Fields`.
+	Prune   bool
+	// Set when the fields are all of the frames the document printed
+	// for the file, as in the editor, so a printed frame that isn't
+	// given a field is removed. Otherwise it's left alone.
+	Complete bool
+}
+
+// A LintFinding is one way a file breaks the ID3v2 spec. See
+// `lintFile`.
+type LintFinding struct {
+	Path     string `json:"path"`
+	// Where in the file the problem is, or -1 if it's nowhere in
+	// particular.
+	Offset   int    `json:"offset"`
+	Severity string `json:"severity"`
+	// A short name for the rule that's broken, like "bad-encoding".
+	Check    string `json:"check"`
+	FrameId  string `json:"frame,omitempty"`
+	Message  string `json:"message"`
+}
+
+type FieldEdit struct {
+	Key   string
+	Value string
+}
+
+type FrameChangeType int
+const (
+	FrameAdded FrameChangeType = iota
+	FrameChanged
+	FrameRemoved
+)
+
+// A FrameChange describes one difference between a file's current
+// tag and the tag an edit would produce.
+type FrameChange struct {
+	Type FrameChangeType
+	Id   string
+	Old  []string
+	New  []string
 }
 
 type TokenType int
@@ -47,8 +254,10 @@ const (
 	TokenUnknown TokenType = iota
 	TokenEOF
 	TokenFilePath
+	TokenFileVersion
 	TokenFieldKey
 	TokenFieldValue
+	TokenFieldDelete
 )
 
 type Token struct {
@@ -58,4 +267,29 @@ type Token struct {
 
 type Lexer struct {
 	Reader *bufio.Reader
+	// Tokens that have been read but not yet returned by `Next`.
+	Queue  []Token
+	// The error that stopped `More`, if any.
+	Err    error
+}
+
+type Journal struct {
+	Name  string
+	Dir   string
+	// The number of entries in the batch.
+	Count int
+}
+
+// A JournalEntry records one tag written to a file. The checksums
+// are of the tag the write replaced, which is saved in the `Backup`
+// file, and of the tag that was written, which is `NewSize` bytes.
+// The file was `FileSize` bytes after the write.
+type JournalEntry struct {
+	Path        string
+	Time        string
+	Backup      string
+	OldChecksum string
+	NewChecksum string
+	NewSize     int
+	FileSize    int64
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+)
+
+
+// Unsynchronisation stops the data in a tag from looking like an MPEG
+// sync signal to players that don't know about tags. After every $FF
+// byte that's followed by a byte with its top three bits set, or by
+// $00, a $00 byte is inserted. Reading reverses that by dropping the
+// $00 after every $FF.
+//
+// v2.2 and v2.3 apply it to the whole tag after the header, and set
+// the tag header's flag. v2.4 applies it to frames separately, setting
+// a flag in each frame's header, though the tag header's flag can
+// still be set to say every frame has it.
+//
+// Refer to section 6.1 of http://id3.org/id3v2.4.0-structure
+
+func removeUnsync(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+// applyUnsync is the inverse of `removeUnsync`. A $00 byte is also
+// added if the data ends with $FF, so the byte that follows the data
+// can't complete a sync signal.
+func applyUnsync(data []byte) []byte {
+	var out []byte
+	for i, b := range data {
+		out = append(out, b)
+		if b == 0xff {
+			if ((i + 1 == len(data)) || (data[i + 1] == 0x00) || (data[i + 1] >= 0xe0)) {
+				out = append(out, 0x00)
+			}
+		}
+	}
+	return out
+}
+
+// needsUnsync returns true if applying unsynchronisation to the data
+// would change it.
+func needsUnsync(data []byte) bool {
+	return len(applyUnsync(data)) != len(data)
+}
+
+// removeReaderUnsync reads the rest of the reader and returns a reader
+// of the data without unsynchronisation.
+func removeReaderUnsync(reader *bufio.Reader) (*bufio.Reader, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return reader, err
+	}
+	return bufio.NewReader(bytes.NewReader(removeUnsync(data))), nil
+}
@@ -12,6 +12,8 @@ import (
 
 
 const V2TAGHEADERSIZE = 10
+// The largest value that fits in four synchsafe bytes.
+const V2MAXSYNCHSAFEINT = (1 << 28) - 1
 
 
 // readV2TagHeader receives a Reader and returns a struct containing
@@ -31,14 +33,17 @@ func readV2TagHeader(reader *bufio.Reader) (ID3v2TagHeader, []byte, error) {
 	var data []byte
 
 	if fileHasV2Tag(reader) {
-		data = readBytes(reader, V2TAGHEADERSIZE)
+		data, err := readBytes(reader, V2TAGHEADERSIZE)
+		if err != nil {
+			return header, data, withOffset(err, 0)
+		}
 		header.Version = int(data[3])
 		header.MinorVersion = int(data[4])
 		header.Size = synchsafeBytesToInt(data[6:])
 		return header, data, nil
 	}
 
-	return header, data, errors.New("File contains no ID3v2 tag.")
+	return header, data, newParseError(ErrNoTag, "")
 }
 
 func fileHasV2Tag(reader *bufio.Reader) bool {
@@ -50,10 +55,28 @@ func fileHasV2Tag(reader *bufio.Reader) bool {
 	return areBytesOk(reader, 3, checkTag)
 }
 
-func fillItemTag(item *Item, header ID3v2TagHeader, data []byte) {
+func fillItemTag(item *Item, header ID3v2TagHeader, data []byte, max_inflate int) error {
 	item.FillTagHeader(&header, data)
 	item.Tag.Header = header
-	item.Tag.Frames = item.ReadFrames()
+
+	frames, err := item.ReadFrames()
+	if err != nil {
+		return err
+	}
+	for i, frame := range frames {
+		frames[i], err = readFrameFormat(header.Version, frame, max_inflate)
+		if err != nil {
+			return err
+		}
+	}
+	// A frame that can't be decrypted is reported, and kept as it is.
+	err = decryptFrames(frames, max_inflate)
+	if err != nil {
+		addProblem(item, err)
+	}
+	item.Tag.Frames = frames
+
+	return nil
 }
 
 // Frame IDs consist of three or four bytes, each in the range
@@ -77,36 +100,35 @@ func areBytesValidFrameId(bytes []byte) bool {
 func synchsafeBytesToInt(data []byte) int {
 	size := int(0)
 	for i, b := range data {
+		shift := uint(len(data) - i - 1) * 7  // 21, 14, 7, 0
+		size |= int(b & 0x7f) << shift
+	}
+	return size
+}
+
+// isSynchsafe returns false if any of the bytes has its top bit set,
+// which a synchsafe integer can't have.
+func isSynchsafe(data []byte) bool {
+	for _, b := range data {
 		//    b: 0111 1111
 		// 0x80: 1000 0000
 		//    &: 0000 0000
 		if (b & 0x80) > 0 {
-			fmt.Println("Size byte had non-zero first bit")
+			return false
 		}
-
-		shift := uint(len(data) - i - 1) * 7  // 21, 14, 7, 0
-		size |= int(b & 0x7f) << shift
 	}
-	// fmt.Printf("WANT TO CONVERT %v\n", data)
-	// synchsafeIntToBytes(size)
-	return size
+	return true
 }
 
+// synchsafeIntToBytes is the inverse of `synchsafeBytesToInt`. It
+// returns the value as four synchsafe bytes, so it can only encode
+// values up to `V2MAXSYNCHSAFEINT`.
 func synchsafeIntToBytes(size int) []byte {
-	//fmt.Printf("CONVERTING %v\n", size)
-	var bytes []byte
-	swing := int(0)
-	for n := 0 ; swing <= size ; n++ {
-		swing = (0x7f << uint(7 * n))
-		byte := uint8((size & swing) >> uint(7 * n))
-		bytes = append(bytes, byte)
-		//fmt.Printf("N: %v, SWING: %v, BYTE: %v, BYTES: %v\n", n, swing, byte, bytes)
-	}
-	for len(bytes) < 4 {
-		bytes = append(bytes, uint8(0))
-	}
-	reverseByteSlice(bytes)
-	//fmt.Printf("CONVERTED %v to %v\n", size, bytes)
+	bytes := make([]byte, 4)
+	for i := range bytes {
+		shift := uint(len(bytes) - i - 1) * 7  // 21, 14, 7, 0
+		bytes[i] = byte((size >> shift) & 0x7f)
+	}
 	return bytes
 }
 
@@ -119,11 +141,15 @@ func bytesToInt(bytes []byte) int {
 	return m
 }
 
-// reverseByteSlice reverses a slice of bytes in place.
-func reverseByteSlice(bytes []byte) {
-	for i, j := 0, len(bytes)-1; i < j; i, j = i+1, j-1 {
-		bytes[i], bytes[j] = bytes[j], bytes[i]
+// intToBytes is the inverse of `bytesToInt`. It returns the value
+// as a big-endian slice of `c` bytes.
+func intToBytes(m int, c int) []byte {
+	bytes := make([]byte, c)
+	for i := range bytes {
+		shift := uint(c - i - 1) * 8
+		bytes[i] = byte(m >> shift)
 	}
+	return bytes
 }
 
 func fileSize(file *os.File) int {
@@ -150,43 +176,58 @@ func areBytesOk(reader *bufio.Reader, size int, test func([]byte) bool) bool {
 	return test(data)
 }
 
-func readBytes(reader *bufio.Reader, c int) []byte {
+func readBytes(reader *bufio.Reader, c int) ([]byte, error) {
 	bytes := make([]byte, c)
 
-	// Read could return fewer than c bytes, so if it does, then
-	// `bytes` will contain 0-value bytes beyond the read bytes.
-	// That could create ambiguity in the receiving function's
-	// interpretation.  @TODO
-	_, err := reader.Read(bytes)
-	if ((err != nil) && (err != io.EOF)) {
-		panic(err)
+	// Read could return fewer than c bytes, which would leave 0-value
+	// bytes at the end of `bytes`. Frames read that way would be
+	// written back corrupted, so keep reading until all c are read,
+	// and fail if there aren't that many.
+	n, err := io.ReadFull(reader, bytes)
+	if ((err == io.EOF) || (err == io.ErrUnexpectedEOF)) {
+		return bytes[:n], newTruncatedError(c, n)
+	} else if err != nil {
+		return bytes, err
 	}
 
-	return bytes
+	return bytes, nil
 }
 
-func readString(reader *bufio.Reader, size int) string {
-	return parseString(readBytes(reader, size))
+
+func readString(reader *bufio.Reader, size int) (string, error) {
+	data, err := readBytes(reader, size)
+	if err != nil {
+		return "", err
+	}
+	return parseString(data), nil
 }
 
 // Parses a string from frame data. The first byte represents the encoding:
-//   0x01  ISO-8859-1
-//   0x02  UTF-16 w/ BOM
-//   0x03  UTF-16BE w/o BOM
-//   0x04  UTF-8
+//   0x00  ISO-8859-1
+//   0x01  UTF-16 w/ BOM
+//   0x02  UTF-16BE w/o BOM
+//   0x03  UTF-8
 //
 // Refer to section 4 of http://id3.org/id3v2.4.0-structure
+//
+// Every encoding can be decoded, so there's no error: UTF-16 without
+// the BOM it should have is read in the byte order it looks to be in.
 func parseString(data []byte) string {
 	var s string
+	if len(data) == 0 {
+		return s
+	}
+
 	switch data[0] {
 	case 0: // ISO-8859-1 text.
 		s = ISO8859_1ToUTF8(data[1:])
 		break
 	case 1: // UTF-16 with BOM.
-		s = string(utf16.Decode(toUTF16(data[1:])))
+		s = decodeUTF16(data[1:], isUTF16BigEndian(data[1:]))
 		break
 	case 2: // UTF-16BE without BOM.
-		panic("Unsupported text encoding UTF-16BE.")  // @TODO
+		s = decodeUTF16(data[1:], true)
+		break
 	case 3: // UTF-8 text.
 		s = string(data[1:])
 		break
@@ -197,6 +238,270 @@ func parseString(data []byte) string {
 	return strings.TrimRight(s, "\u0000")
 }
 
+// encodeString is the inverse of `parseString`. It returns the
+// encoding byte followed by the encoded text.
+func encodeString(s string, version int) []byte {
+	encoding := pickEncoding(s, version)
+	return append([]byte{encoding}, encodeStringAs(s, encoding)...)
+}
+
+// pickEncoding returns the encoding byte to use for the text.
+// ISO-8859-1 is used when the text allows it. Otherwise v2.2 and
+// v2.3 tags get UTF-16 with a BOM and v2.4 tags get UTF-8.
+func pickEncoding(s string, version int) byte {
+	if _, ok := UTF8ToISO8859_1(s); ok {
+		return 0
+	} else if version == 4 {
+		return 3
+	}
+	return 1
+}
+
+// encodeStringAs returns the text in the given encoding, without the
+// encoding byte. Characters ISO-8859-1 can't encode are dropped.
+func encodeStringAs(s string, encoding byte) []byte {
+	var bytes []byte
+	if encoding == 0 {
+		for _, r := range s {
+			if r <= 0xFF {
+				bytes = append(bytes, byte(r))
+			}
+		}
+	} else if encoding == 3 {
+		bytes = []byte(s)
+	} else {
+		if encoding == 1 {
+			bytes = append(bytes, 0xFF, 0xFE)
+		}
+		for _, unit := range utf16.Encode([]rune(s)) {
+			if encoding == 1 {
+				bytes = append(bytes, byte(unit), byte(unit >> 8))
+			} else {
+				bytes = append(bytes, byte(unit >> 8), byte(unit))
+			}
+		}
+	}
+	return bytes
+}
+
+// isLangTextFrame checks whether frames with the ID give a language
+// and a description before their text, like comments and lyrics.
+func isLangTextFrame(id string) bool {
+	return ((id == "COMM") || (id == "USLT") || (id == "COM") || (id == "ULT"))
+}
+
+// parseLangText parses the body of a comment or lyrics frame: an
+// encoding byte, a three-character language code, a terminated
+// description, and the text. It returns the language, description,
+// and text.
+func parseLangText(body []byte) (string, string, string) {
+	if len(body) < 4 {
+		return "", "", ""
+	}
+	lang := string(body[1:4])
+	rest := body[4:]
+
+	end, width := findStringEnd(rest, body[0])
+	if end < 0 {
+		return lang, "", parseLangTextPart(body[0], rest)
+	}
+	return lang, parseLangTextPart(body[0], rest[:end]), parseLangTextPart(body[0], rest[(end + width):])
+}
+
+func parseLangTextPart(encoding byte, data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return parseString(append([]byte{encoding}, data...))
+}
+
+// makeLangTextBody is the inverse of `parseLangText`.
+func makeLangTextBody(lang string, description string, text string, version int) []byte {
+	encoding := pickEncoding(description + text, version)
+	body := append([]byte{encoding}, []byte(lang)...)
+	body = append(body, encodeStringAs(description, encoding)...)
+	if ((encoding == 1) || (encoding == 2)) {
+		body = append(body, 0, 0)
+	} else {
+		body = append(body, 0)
+	}
+	return append(body, encodeStringAs(text, encoding)...)
+}
+
+// isUserDefinedFrame checks whether frames with the ID give a
+// description before their value, like TXXX and WXXX.
+func isUserDefinedFrame(id string) bool {
+	return ((id == "TXXX") || (id == "WXXX") || (id == "TXX") || (id == "WXX"))
+}
+
+// parseUserDefinedText parses the body of a user-defined text or URL
+// frame: an encoding byte, a terminated description, and the value.
+// A URL is ISO-8859-1 whatever the encoding byte says. It returns the
+// description and the value.
+func parseUserDefinedText(id string, body []byte) (string, string) {
+	if len(body) < 1 {
+		return "", ""
+	}
+	rest := body[1:]
+	end, width := findStringEnd(rest, body[0])
+	if end < 0 {
+		return parseLangTextPart(body[0], rest), ""
+	}
+
+	description := parseLangTextPart(body[0], rest[:end])
+	value := rest[(end + width):]
+	if id[0:1] == "W" {
+		return description, strings.TrimRight(ISO8859_1ToUTF8(value), "\u0000")
+	}
+	return description, parseLangTextPart(body[0], value)
+}
+
+// makeUserDefinedBody is the inverse of `parseUserDefinedText`. The
+// value of a text frame can be several strings separated by NULs,
+// which are each encoded on their own.
+func makeUserDefinedBody(id string, description string, value string, version int) ([]byte, error) {
+	var encoding byte
+	if id[0:1] == "W" {
+		encoding = pickEncoding(description, version)
+	} else {
+		encoding = pickEncoding(description + value, version)
+	}
+
+	body := append([]byte{encoding}, encodeStringAs(description, encoding)...)
+	terminator := []byte{0}
+	if ((encoding == 1) || (encoding == 2)) {
+		terminator = []byte{0, 0}
+	}
+	body = append(body, terminator...)
+
+	if id[0:1] == "W" {
+		latin, ok := UTF8ToISO8859_1(value)
+		if !ok {
+			return nil, errors.New("URLs must be ISO-8859-1 text")
+		}
+		return append(body, latin...), nil
+	}
+	for i, part := range strings.Split(value, "\u0000") {
+		if i > 0 {
+			body = append(body, terminator...)
+		}
+		body = append(body, encodeStringAs(part, encoding)...)
+	}
+	return body, nil
+}
+
+// findStringEnd returns the index of the terminator that ends the
+// first string in the data, and the terminator's width, which is two
+// bytes for UTF-16 and one for others. The index is -1 if there is no
+// terminator.
+func findStringEnd(data []byte, encoding byte) (int, int) {
+	if ((encoding == 1) || (encoding == 2)) {
+		for i := 0; i + 1 < len(data); i += 2 {
+			if ((data[i] == 0) && (data[i + 1] == 0)) {
+				return i, 2
+			}
+		}
+		return -1, 2
+	}
+	for i, b := range data {
+		if b == 0 {
+			return i, 1
+		}
+	}
+	return -1, 1
+}
+
+// frameValue returns the value of a text, URL, comment or lyrics
+// frame as it's shown and edited.
+func frameValue(frame ID3v2Frame) string {
+	if len(frame.Body) == 0 {
+		return ""
+	} else if isLangTextFrame(frame.Header.Id) {
+		_, _, text := parseLangText(frame.Body)
+		return text
+	}
+	return parseString(frame.Body)
+}
+
+// frameValues returns the values of a frame. Text frames can hold
+// several. v2.4 separates them with NULs, which writers use in earlier
+// versions too. Those versions say to separate the people in a list of
+// people with "/", and writers also use "; " for those and for genres.
+// The first value of a user-defined frame is its description.
+func frameValues(frame ID3v2Frame, version int) []string {
+	if ((isUserDefinedFrame(frame.Header.Id)) && (len(frame.Body) > 0)) {
+		description, value := parseUserDefinedText(frame.Header.Id, frame.Body)
+		if frame.Header.Id[0:1] == "W" {
+			return []string{description, value}
+		}
+		return append([]string{description}, strings.Split(value, "\u0000")...)
+	}
+
+	value := frameValue(frame)
+	if ((len(frame.Header.Id) < 1) || (frame.Header.Id[0:1] != "T")) {
+		return []string{value}
+	}
+
+	values := strings.Split(value, "\u0000")
+	if ((version < 4) && (isListFrame(frame.Header.Id))) {
+		var split []string
+		for _, value := range values {
+			for _, part := range strings.Split(value, "; ") {
+				split = append(split, strings.Split(part, "/")...)
+			}
+		}
+		values = split
+	}
+	return values
+}
+
+// isListFrame checks whether a v2.2 or v2.3 frame with the ID holds a
+// list of people or genres.
+func isListFrame(id string) bool {
+	lists := map[string]bool{
+		"TPE1": true, "TPE2": true, "TPE3": true, "TPE4": true,
+		"TCOM": true, "TEXT": true, "TOLY": true, "TOPE": true, "TCON": true,
+		"TP1": true, "TP2": true, "TP3": true, "TP4": true,
+		"TCM": true, "TXT": true, "TOL": true, "TOA": true, "TCO": true,
+	}
+	return lists[id]
+}
+
+// joinFrameValues is the inverse of `frameValues`, less the
+// description of user-defined frames. v2.4 text frames, and
+// user-defined ones, are joined with NULs. Others are joined with the
+// separator.
+func joinFrameValues(id string, values []string, version int, separator string) string {
+	if ((version == 4) || (id == "TXXX") || (id == "TXX")) {
+		return strings.Join(values, "\u0000")
+	}
+	return strings.Join(values, separator)
+}
+
+// printFrameValues prints the frame's values, one per line, or on one
+// line joined with the separator if there is one.
+func printFrameValues(out io.Writer, name string, frame ID3v2Frame, version int, separator string) {
+	values := frameValues(frame, version)
+	if separator != "" {
+		values = []string{strings.Join(values, separator)}
+	}
+	for _, value := range values {
+		fmt.Fprintf(out, "%v: %v\n", name, formatFieldValue(value))
+	}
+}
+
+// isMainLangTextFrame checks whether the frame is a comment or lyrics
+// frame without a description. Those are the ones that are printed
+// and edited. Others are usually written by programs for their own
+// use, like iTunes' gapless playback data.
+func isMainLangTextFrame(frame ID3v2Frame) bool {
+	if !isLangTextFrame(frame.Header.Id) {
+		return false
+	}
+	_, description, _ := parseLangText(frame.Body)
+	return description == ""
+}
+
 func ISO8859_1ToUTF8(data []byte) string {
 	p := make([]rune, len(data))
 	for i, b := range data {
@@ -205,32 +510,85 @@ func ISO8859_1ToUTF8(data []byte) string {
 	return string(p)
 }
 
-func toUTF16(data []byte) []uint16 {
-	if len(data) < 2 {
-		panic("Sequence is too short too contain a UTF-16 BOM")
+// UTF8ToISO8859_1 returns the ISO-8859-1 bytes for the string and
+// true, or false if the string contains characters outside that set.
+func UTF8ToISO8859_1(s string) ([]byte, bool) {
+	var bytes []byte
+	for _, r := range s {
+		if r > 0xFF {
+			return nil, false
+		}
+		bytes = append(bytes, byte(r))
 	}
-	if len(data)%2 > 0 {
-		// TODO: if this is UTF-16 BE then this is likely encoded wrong
-		data = append(data, 0)
+	return bytes, true
+}
+
+// decodeUTF16 decodes UTF-16 text, which may be several strings, each
+// ended by a terminator. A string starting with a BOM is read in the
+// byte order the BOM gives, whatever the encoding byte said, and others
+// in the byte order given. The strings are returned separated by NULs.
+func decodeUTF16(data []byte, big_endian bool) string {
+	var parts []string
+	for len(data) > 0 {
+		end, width := findStringEnd(data, 1)
+		if end < 0 {
+			end = len(data)
+			width = 0
+		}
+		parts = append(parts, string(utf16.Decode(toUTF16(data[:end], big_endian))))
+		data = data[end + width:]
 	}
+	return strings.Join(parts, "\u0000")
+}
 
-	var shift0, shift1 uint
-	if data[0] == 0xFF && data[1] == 0xFE {
-		// UTF-16 LE
-		shift0 = 0
-		shift1 = 8
-	} else if data[0] == 0xFE && data[1] == 0xFF {
-		// UTF-16 BE
-		shift0 = 8
-		shift1 = 0
-		panic("UTF-16 BE found!")
-	} else {
-		panic(fmt.Sprintf("Unrecognized UTF-16 BOM: 0x%02X%02X", data[0], data[1]))
+// isUTF16BigEndian guesses the byte order of UTF-16 text that should
+// start with a BOM. Without one, text in the Latin alphabets, which
+// most tags are in, has more zero bytes in the high byte of each unit
+// than the low one. A tie means big-endian, as Unicode says it should.
+func isUTF16BigEndian(data []byte) bool {
+	if len(data) >= 2 {
+		if ((data[0] == 0xFE) && (data[1] == 0xFF)) {
+			return true
+		} else if ((data[0] == 0xFF) && (data[1] == 0xFE)) {
+			return false
+		}
+	}
+	even, odd := 0, 0
+	for i := 0; i + 1 < len(data); i += 2 {
+		if data[i] == 0 {
+			even++
+		}
+		if data[i + 1] == 0 {
+			odd++
+		}
 	}
+	return even >= odd
+}
 
-	s := make([]uint16, 0, len(data)/2)
-	for i := 2; i < len(data); i += 2 {
-		s = append(s, uint16(data[i])<<shift0|uint16(data[i+1])<<shift1)
+// toUTF16 returns the units of one UTF-16 string, without its BOM if
+// it has one. A trailing odd byte, which some writers leave, is taken
+// as a unit of its own.
+func toUTF16(data []byte, big_endian bool) []uint16 {
+	if len(data) >= 2 {
+		if ((data[0] == 0xFE) && (data[1] == 0xFF)) {
+			big_endian = true
+			data = data[2:]
+		} else if ((data[0] == 0xFF) && (data[1] == 0xFE)) {
+			big_endian = false
+			data = data[2:]
+		}
+	}
+
+	s := make([]uint16, 0, (len(data) + 1) / 2)
+	for i := 0; i + 1 < len(data); i += 2 {
+		if big_endian {
+			s = append(s, uint16(data[i]) << 8 | uint16(data[i + 1]))
+		} else {
+			s = append(s, uint16(data[i]) | uint16(data[i + 1]) << 8)
+		}
+	}
+	if ((len(data) % 2 > 0) && (data[len(data) - 1] != 0)) {
+		s = append(s, uint16(data[len(data) - 1]))
 	}
 	return s
 }
@@ -248,7 +606,16 @@ func isBitOn(byte byte, pos int) bool {
 	//    1: 0000 0001
 	// 1<<7: 1000 0000
 	//  F&1: 1000 0000
-	return (byte & (1 << uint(pos))) == 1
+	return (byte & (1 << uint(pos))) != 0
+}
+
+// setBit is the inverse of `isBitOn`. It returns the byte with the
+// bit at the given position set if `on` is true, or cleared if not.
+func setBit(byte byte, pos int, on bool) byte {
+	if on {
+		return byte | (1 << uint(pos))
+	}
+	return byte &^ (1 << uint(pos))
 }
 
 // Use makeMap to make a map from a slice of string tuples.
@@ -263,11 +630,23 @@ func makeMap(parts [][2]string, pull func([2]string) (string, string)) map[strin
 	return _map
 }
 
-func makeTagFrame(reader *bufio.Reader, header ID3v2FrameHeader) ID3v2Frame {
+func makeTagFrame(reader *bufio.Reader, header ID3v2FrameHeader) (ID3v2Frame, error) {
 	frame := ID3v2Frame{ }
 	frame.Header = header
-	frame.Body = readBytes(reader, header.Size)
-	return frame
+
+	// A frame must be at least one byte, not counting its header,
+	// but some writers leave empty ones. Those are given no body, and
+	// the frame readers skip them so they aren't written back.
+	if header.Size < 1 {
+		return frame, nil
+	}
+
+	body, err := readBytes(reader, header.Size)
+	if err != nil {
+		return frame, withFrameId(err, header.Id)
+	}
+	frame.Body = body
+	return frame, nil
 }
 
 func makeFrameValidator(keys map[string]string, size int) func (frame ID3v2Frame) bool {
@@ -283,9 +662,18 @@ func makeFrameValidator(keys map[string]string, size int) func (frame ID3v2Frame
 	return check
 }
 
-func printItemData(item *Item) {
-	fmt.Printf("[%v:%v]\n", item.Tag.Header.Version, item.Path)
-	item.PrintFrames(item.Tag.Frames)
+// printItemData prints the item's tag as an edit document. Values are
+// separated as `printFrameValues` says.
+func printItemData(out io.Writer, item *Item, separator string) {
+	fmt.Fprintf(out, "[%v:%v]\n", item.Tag.Header.Version, item.Path)
+	printTagLocations(out, item)
+	extended := item.Tag.ExtendedHeader
+	if ((extended != nil) && (extended.HasRestrictions)) {
+		for _, restriction := range describeTagRestrictions(extended.Restrictions) {
+			fmt.Fprintf(out, "# Restriction: %s.\n", restriction)
+		}
+	}
+	item.PrintFrames(out, item.Tag.Frames, separator)
 }
 
 // This isn't being used?  @TODO
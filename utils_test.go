@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+
+// makeTestFrame returns a frame as it's stored in a tag of the given
+// version. `flags` is the two flag bytes, which v2.2 frames don't
+// have, and defaults to none.
+func makeTestFrame(version int, id string, flags []byte, body []byte) []byte {
+	if flags == nil {
+		flags = []byte{0, 0}
+	}
+	data := []byte(id)
+	if version == 2 {
+		return append(append(data, intToBytes(len(body), V22TAGSIZESIZE)...), body...)
+	} else if version == 3 {
+		data = append(data, intToBytes(len(body), V23TAGSIZESIZE)...)
+	} else {
+		data = append(data, synchsafeIntToBytes(len(body))...)
+	}
+	data = append(data, flags...)
+	return append(data, body...)
+}
+
+// makeTestTag returns a tag of the given version holding the frames,
+// followed by some padding and a little audio.
+func makeTestTag(version int, frames ...[]byte) []byte {
+	var body []byte
+	for _, frame := range frames {
+		body = append(body, frame...)
+	}
+	body = append(body, make([]byte, 16)...)
+
+	data := []byte{'I', 'D', '3', byte(version), 0, 0}
+	data = append(data, synchsafeIntToBytes(len(body))...)
+	data = append(data, body...)
+	return append(data, 0xff, 0xfb, 0x90, 0x00)
+}
+
+// writeTestFile writes the data to a file in a temporary directory
+// and returns its path.
+func writeTestFile(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "test.mp3")
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseString(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"\x00caf\xe9\x00", "café"},
+		{"\x01\xff\xfeA\x00\xa9\x03", "AΩ"},
+		{"\x01\xfe\xff\x00A\x03\xa9", "AΩ"},
+		{"\x01A\x00B\x00", "AB"},
+		{"\x01\x00A\x00B", "AB"},
+		{"\x01\xff\xfeA\x00\x00\x00\xfe\xff\x00B\x00\x00", "A\u0000B"},
+		{"\x02\x00A\x03\xa9", "AΩ"},
+		{"\x03caf\xc3\xa9\x00B", "café\u0000B"},
+		{"Title", "Title"},
+	}
+	for _, test := range tests {
+		s := parseString([]byte(test.data))
+		if s != test.want {
+			t.Errorf("%q: parsed as %q, want %q", test.data, s, test.want)
+		}
+	}
+}
+
+func TestFrameValues(t *testing.T) {
+	tests := []struct {
+		id      string
+		body    string
+		version int
+		want    []string
+	}{
+		{"TIT2", "\x00A/B", 3, []string{"A/B"}},
+		{"TPE1", "\x00A/B; C", 3, []string{"A", "B", "C"}},
+		{"TPE1", "\x00A/B\x00C", 4, []string{"A/B", "C"}},
+		{"TP1", "\x00A/B", 2, []string{"A", "B"}},
+		{"TIT2", "\x03A\x00B\x00", 4, []string{"A", "B"}},
+		{"COMM", "\x00engDescription\x00Text", 3, []string{"Text"}},
+		{"WOAR", "http://example.com/", 3, []string{"http://example.com/"}},
+		{"TXXX", "\x00Description\x00A\x00B", 4, []string{"Description", "A", "B"}},
+		{"WXXX", "\x01\xff\xfeD\x00\x00\x00http://example.com/", 3, []string{"D", "http://example.com/"}},
+	}
+	for _, test := range tests {
+		frame := ID3v2Frame{Header: ID3v2FrameHeader{Id: test.id}, Body: []byte(test.body)}
+		values := frameValues(frame, test.version)
+		if !areValuesEqual(values, test.want) {
+			t.Errorf("%s %q: values are %q, want %q", test.id, test.body, values, test.want)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"bufio"
-	"fmt"
+	"io"
 )
 
 // http://id3.org/id3v2-00
@@ -16,7 +16,16 @@ func v22MakeItem(path string, reader *bufio.Reader) *Item {
 	item := Item{ }
 	item.Path = path
 	item.FillTagHeader = v22FillTagHeader
-	item.ReadFrames = func () []ID3v2Frame {
+	item.ReadFrames = func () ([]ID3v2Frame, error) {
+		// The frames are read from the tag as it was before
+		// unsynchronisation was applied.
+		if item.Tag.Header.Unsynchronization {
+			decoded, err := removeReaderUnsync(reader)
+			if err != nil {
+				return nil, err
+			}
+			return v22ReadFrames(decoded)
+		}
 		return v22ReadFrames(reader)
 	}
 	item.PrintFrames = v22PrintFrames
@@ -29,23 +38,56 @@ func v22FillTagHeader(header *ID3v2TagHeader, data []byte) {
 	header.Compression = isBitOn(data[5], 6)
 }
 
-func v22ReadFrames(reader *bufio.Reader) []ID3v2Frame {
+// v22MakeTagHeaderFlags is the inverse of `v22FillTagHeader`. The
+// compression flag is never set: the spec doesn't define a scheme.
+func v22MakeTagHeaderFlags(header ID3v2TagHeader) byte {
+	return setBit(0, 7, header.Unsynchronization)
+}
+
+func v22ReadFrames(reader *bufio.Reader) ([]ID3v2Frame, error) {
 	var frames []ID3v2Frame
+	// The offset in the file of the frame being read.
+	offset := V2TAGHEADERSIZE
 	for areBytesOk(reader, V22TAGIDSIZE, areBytesValidFrameId) {
-		header := v22ReadFrameHeader(reader)
-		frames = append(frames, makeTagFrame(reader, header))
+		header, err := v22ReadFrameHeader(reader)
+		if err != nil {
+			return frames, withOffset(err, offset)
+		}
+		frame, err := makeTagFrame(reader, header)
+		if err != nil {
+			return frames, withOffset(err, offset)
+		}
+		if len(frame.Body) > 0 {
+			frames = append(frames, frame)
+		}
+		offset += V22TAGIDSIZE + V22TAGSIZESIZE + header.Size
 	}
-	return frames
+	return frames, nil
 }
 
-func v22ReadFrameHeader(reader *bufio.Reader) ID3v2FrameHeader {
+func v22ReadFrameHeader(reader *bufio.Reader) (ID3v2FrameHeader, error) {
 	header := ID3v2FrameHeader{ }
-	header.Id = string(readBytes(reader, V22TAGIDSIZE))
-	header.Size = bytesToInt(readBytes(reader, V22TAGSIZESIZE))
-	return header
+	id, err := readBytes(reader, V22TAGIDSIZE)
+	if err != nil {
+		return header, err
+	}
+	header.Id = string(id)
+	size, err := readBytes(reader, V22TAGSIZESIZE)
+	if err != nil {
+		return header, withFrameId(err, header.Id)
+	}
+	header.Size = bytesToInt(size)
+	return header, nil
+}
+
+func v22MakeFrameHeaderBytes(header ID3v2FrameHeader) []byte {
+	var bytes []byte
+	bytes = append(bytes, []byte(header.Id)...)
+	bytes = append(bytes, intToBytes(header.Size, V22TAGSIZESIZE)...)
+	return bytes
 }
 
-func v22PrintFrames(frames []ID3v2Frame) {
+func v22PrintFrames(out io.Writer, frames []ID3v2Frame, separator string) {
 	pull := func (part [2]string) (string, string) {
 		return part[0], part[1]
 	}
@@ -54,7 +96,7 @@ func v22PrintFrames(frames []ID3v2Frame) {
 
 	for _, frame := range frames {
 		if v22IsFrameEditable(keys, frame) {
-			fmt.Printf("%v: %v\n", keys[frame.Header.Id], parseString(frame.Body))
+			printFrameValues(out, keys[frame.Header.Id], frame, 2, separator)
 		}//  else {
 		// 	fmt.Printf("Frame is not text frame (%v)\n", frame.Header.Id)
 		// }
@@ -64,7 +106,7 @@ func v22PrintFrames(frames []ID3v2Frame) {
 // This function could be replaced with `makeFrameValidator`
 func v22IsFrameEditable(keys map[string]string, frame ID3v2Frame) bool {
 	if ((len(frame.Header.Id) == V22TAGIDSIZE) &&
-		((frame.Header.Id[0:1] == "T") || (frame.Header.Id[0:1] == "W"))) {
+		((frame.Header.Id[0:1] == "T") || (frame.Header.Id[0:1] == "W") || isMainLangTextFrame(frame))) {
 		_, present := keys[frame.Header.Id]
 		return present
 	} else {
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 )
 
 // http://id3.org/id3v2.3.0
@@ -17,8 +20,38 @@ func v23MakeItem(path string, reader *bufio.Reader) *Item {
 	item := Item{ }
 	item.Path = path
 	item.FillTagHeader = v23FillTagHeader
-	item.ReadFrames = func () []ID3v2Frame {
-		return v23ReadFrames(reader)
+	item.ReadFrames = func () ([]ID3v2Frame, error) {
+		// The frames are read from the tag as it was before
+		// unsynchronisation was applied.
+		if item.Tag.Header.Unsynchronization {
+			decoded, err := removeReaderUnsync(reader)
+			if err != nil {
+				return nil, err
+			}
+			reader = decoded
+		}
+
+		offset := V2TAGHEADERSIZE
+		if item.Tag.Header.Extended {
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			extended, err := v23ReadExtendedHeader(data)
+			if err != nil {
+				return nil, withOffset(err, offset)
+			}
+			item.Tag.ExtendedHeader = &extended
+			data = data[extended.Size:]
+			// A bad CRC is reported, but the frames are read anyway.
+			err = checkExtendedHeaderCRC(3, extended, data)
+			if err != nil {
+				addProblem(&item, err)
+			}
+			reader = bufio.NewReader(bytes.NewReader(data))
+			offset += extended.Size
+		}
+		return v23ReadFrames(reader, offset)
 	}
 	item.PrintFrames = v23PrintFrames
 	return &item
@@ -30,25 +63,123 @@ func v23FillTagHeader(header *ID3v2TagHeader, data []byte) {
 	header.Experimental = isBitOn(data[5], 5)
 }
 
-func v23ReadFrames(reader *bufio.Reader) []ID3v2Frame {
+// v23MakeTagHeaderFlags is the inverse of `v23FillTagHeader`. The
+// extended header isn't written, so that flag isn't set.
+func v23MakeTagHeaderFlags(header ID3v2TagHeader) byte {
+	flags := setBit(0, 7, header.Unsynchronization)
+	return setBit(flags, 5, header.Experimental)
+}
+
+// v23ReadFrames reads frames until it meets padding or the end of the
+// tag. `offset` is where the first frame is in the file.
+func v23ReadFrames(reader *bufio.Reader, offset int) ([]ID3v2Frame, error) {
 	var frames []ID3v2Frame
 	for areBytesOk(reader, V23TAGIDSIZE, areBytesValidFrameId) {
-		header := v23ReadFrameHeader(reader)
-		frames = append(frames, makeTagFrame(reader, header))
+		header, err := v23ReadFrameHeader(reader)
+		if err != nil {
+			return frames, withOffset(err, offset)
+		}
+		frame, err := makeTagFrame(reader, header)
+		if err != nil {
+			return frames, withOffset(err, offset)
+		}
+		if len(frame.Body) > 0 {
+			frames = append(frames, frame)
+		}
+		offset += V23TAGIDSIZE + V23TAGSIZESIZE + V23TAGFLAGSSIZE + header.Size
+	}
+	return frames, nil
+}
+
+// v23ReadExtendedHeader reads the extended header from the start of
+// the data, which is the tag following its header. It's made of:
+// 0-3: the size of the rest of the extended header, 6 or 10
+// 4-5: flags. The first bit says whether there's a CRC
+// 6-9: the size of the padding
+// 10-13: the CRC, if there is one
+func v23ReadExtendedHeader(data []byte) (ID3v2ExtendedHeader, error) {
+	extended := ID3v2ExtendedHeader{ }
+	if len(data) < 10 {
+		return extended, newParseError(ErrBadExtendedHeader, "too short")
+	}
+
+	extended.Size = 4 + bytesToInt(data[0:4])
+	extended.HasCRC = isBitOn(data[4], 7)
+	extended.PaddingSize = bytesToInt(data[6:10])
+
+	want := 10
+	if extended.HasCRC {
+		want = 14
+	}
+	if ((extended.Size != want) || (extended.Size > len(data))) {
+		return extended, newParseError(ErrBadExtendedHeader, fmt.Sprintf("size is %d", extended.Size))
+	}
+	if extended.PaddingSize > len(data) - extended.Size {
+		return extended, newParseError(ErrBadExtendedHeader, fmt.Sprintf("padding size is %d", extended.PaddingSize))
 	}
-	return frames
+	if extended.HasCRC {
+		extended.CRC = uint32(bytesToInt(data[10:14]))
+	}
+	return extended, nil
 }
 
-func v23ReadFrameHeader(reader *bufio.Reader) ID3v2FrameHeader {
+func v23ReadFrameHeader(reader *bufio.Reader) (ID3v2FrameHeader, error) {
 	header := ID3v2FrameHeader{ }
-	header.Id = string(readBytes(reader, V23TAGIDSIZE))
-	header.Size = bytesToInt(readBytes(reader, V23TAGSIZESIZE))
-	// Need to parse and appropriately handle these flags  @TODO
-	header.Flags = readBytes(reader, V23TAGFLAGSSIZE)
-	return header
+	id, err := readBytes(reader, V23TAGIDSIZE)
+	if err != nil {
+		return header, err
+	}
+	header.Id = string(id)
+	size, err := readBytes(reader, V23TAGSIZESIZE)
+	if err != nil {
+		return header, withFrameId(err, header.Id)
+	}
+	header.Size = bytesToInt(size)
+	flags, err := readBytes(reader, V23TAGFLAGSSIZE)
+	if err != nil {
+		return header, withFrameId(err, header.Id)
+	}
+	header.Flags = v23ReadFrameFlags(flags)
+	return header, nil
+}
+
+// v23ReadFrameFlags decodes the two flag bytes of a frame header:
+// %abc00000 %ijk00000
+// a: discard on tag alteration, b: discard on file alteration,
+// c: read only, i: compressed, j: encrypted, k: grouped
+func v23ReadFrameFlags(data []byte) FrameFlags {
+	return FrameFlags{
+		DiscardOnTagAlter: isBitOn(data[0], 7),
+		DiscardOnFileAlter: isBitOn(data[0], 6),
+		ReadOnly: isBitOn(data[0], 5),
+		Compressed: isBitOn(data[1], 7),
+		Encrypted: isBitOn(data[1], 6),
+		Grouped: isBitOn(data[1], 5),
+	}
+}
+
+// v23MakeFrameFlagBytes is the inverse of `v23ReadFrameFlags`. The
+// flags v2.3 doesn't have are left out.
+func v23MakeFrameFlagBytes(flags FrameFlags) []byte {
+	var status, format byte
+	status = setBit(status, 7, flags.DiscardOnTagAlter)
+	status = setBit(status, 6, flags.DiscardOnFileAlter)
+	status = setBit(status, 5, flags.ReadOnly)
+	format = setBit(format, 7, flags.Compressed)
+	format = setBit(format, 6, flags.Encrypted)
+	format = setBit(format, 5, flags.Grouped)
+	return []byte{status, format}
+}
+
+func v23MakeFrameHeaderBytes(header ID3v2FrameHeader) []byte {
+	var bytes []byte
+	bytes = append(bytes, []byte(header.Id)...)
+	bytes = append(bytes, intToBytes(header.Size, V23TAGSIZESIZE)...)
+	bytes = append(bytes, v23MakeFrameFlagBytes(header.Flags)...)
+	return bytes
 }
 
-func v23PrintFrames(frames []ID3v2Frame) {
+func v23PrintFrames(out io.Writer, frames []ID3v2Frame, separator string) {
 	pull := func (part [2]string) (string, string) {
 		return part[0], part[1]
 	}
@@ -57,7 +188,7 @@ func v23PrintFrames(frames []ID3v2Frame) {
 
 	for _, frame := range frames {
 		if v23IsFrameEditable(keys, frame) {
-			fmt.Printf("%v: %v\n", keys[frame.Header.Id], parseString(frame.Body))
+			printFrameValues(out, keys[frame.Header.Id], frame, 3, separator)
 		}// else {
 		// 	fmt.Printf("Frame is not text frame (%v)\n", frame.Header.Id)
 		// }
@@ -66,8 +197,8 @@ func v23PrintFrames(frames []ID3v2Frame) {
 
 // This function could be replaced with `makeFrameValidator`
 func v23IsFrameEditable(keys map[string]string, frame ID3v2Frame) bool {
-	if ((len(frame.Header.Id) == V23TAGIDSIZE) &&
-		((frame.Header.Id[0:1] == "T") || (frame.Header.Id[0:1] == "W"))) {
+	if ((len(frame.Header.Id) == V23TAGIDSIZE) && (isFrameReadable(frame)) &&
+		((frame.Header.Id[0:1] == "T") || (frame.Header.Id[0:1] == "W") || isMainLangTextFrame(frame))) {
 		_, present := keys[frame.Header.Id]
 		return present
 	} else {
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 )
 
 // http://id3.org/id3v2.4.0-structure
@@ -18,8 +21,33 @@ func v24MakeItem(path string, reader *bufio.Reader) *Item {
 	item := Item{ }
 	item.Path = path
 	item.FillTagHeader = v24FillTagHeader
-	item.ReadFrames = func () []ID3v2Frame {
-		return v24ReadFrames(reader)
+	item.ReadFrames = func () ([]ID3v2Frame, error) {
+		// The whole tag is read first, so the frame sizes can be
+		// checked before any frame is read.
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		offset := V2TAGHEADERSIZE
+		if item.Tag.Header.Extended {
+			extended, err := v24ReadExtendedHeader(data)
+			if err != nil {
+				return nil, withOffset(err, offset)
+			}
+			item.Tag.ExtendedHeader = &extended
+			data = data[extended.Size:]
+			// A bad CRC is reported, but the frames are read anyway.
+			err = checkExtendedHeaderCRC(4, extended, data)
+			if err != nil {
+				addProblem(&item, err)
+			}
+			offset += extended.Size
+		}
+
+		frames, plain, err := v24ReadFrames(data, offset, item.Tag.Header.Unsynchronization)
+		item.Tag.PlainFrameSizes = plain
+		return frames, err
 	}
 	item.PrintFrames = v24PrintFrames
 	return &item
@@ -32,25 +60,239 @@ func v24FillTagHeader(header *ID3v2TagHeader, data []byte) {
 	header.Footer = isBitOn(data[5], 4)
 }
 
-func v24ReadFrames(reader *bufio.Reader) []ID3v2Frame {
+// v24MakeTagHeaderFlags is the inverse of `v24FillTagHeader`. The
+// extended header isn't written, so that flag isn't set. Neither is
+// the unsynchronisation flag, since it's set on each frame instead.
+// See `makeTagBytes`.
+func v24MakeTagHeaderFlags(header ID3v2TagHeader) byte {
+	flags := setBit(0, 5, header.Experimental)
+	return setBit(flags, 4, header.Footer)
+}
+
+// v24ReadFrames reads the frames in the data, which is the tag after
+// its headers. `offset` is where the data is in the file. It also
+// returns whether the frame sizes had to be read as plain integers.
+// See `v24HasPlainFrameSizes`. If `unsync` is true, every frame is
+// taken to be unsynchronised.
+func v24ReadFrames(data []byte, offset int, unsync bool) ([]ID3v2Frame, bool, error) {
 	var frames []ID3v2Frame
+	plain := v24HasPlainFrameSizes(data)
+	reader := bufio.NewReader(bytes.NewReader(data))
 	for areBytesOk(reader, V24TAGIDSIZE, areBytesValidFrameId) {
-		header := v24ReadFrameHeader(reader)
-		frames = append(frames, makeTagFrame(reader, header))
+		header, err := v24ReadFrameHeader(reader, plain)
+		if err != nil {
+			return frames, plain, withOffset(err, offset)
+		}
+		frame, err := makeTagFrame(reader, header)
+		if err != nil {
+			return frames, plain, withOffset(err, offset)
+		}
+		if len(frame.Body) > 0 {
+			frames = append(frames, v24RemoveFrameUnsync(frame, unsync))
+		}
+		offset += V24TAGIDSIZE + V24TAGSIZESIZE + V24TAGFLAGSSIZE + header.Size
+	}
+	return frames, plain, nil
+}
+
+// v24ReadExtendedHeader reads the extended header from the start of
+// the data, which is the tag following its header. It's made of:
+// 0-3: the size of the whole extended header, synchsafe
+// 4: the number of flag bytes, always 1
+// 5: flags: %0bcd0000
+//    b: the tag is an update
+//    c: there's a CRC
+//    d: there are restrictions
+// Each set flag is followed, in that order, by a byte giving the size
+// of its data and then the data: none for b, a five byte synchsafe
+// integer for c, and one byte for d.
+func v24ReadExtendedHeader(data []byte) (ID3v2ExtendedHeader, error) {
+	extended := ID3v2ExtendedHeader{ }
+	if len(data) < 6 {
+		return extended, newParseError(ErrBadExtendedHeader, "too short")
+	}
+
+	extended.Size = synchsafeBytesToInt(data[0:4])
+	if ((extended.Size < 6) || (extended.Size > len(data))) {
+		return extended, newParseError(ErrBadExtendedHeader, fmt.Sprintf("size is %d", extended.Size))
+	}
+	if data[4] != 1 {
+		return extended, newParseError(ErrBadExtendedHeader, fmt.Sprintf("%d flag bytes", data[4]))
+	}
+
+	flags := data[5]
+	extended.Update = isBitOn(flags, 6)
+	extended.HasCRC = isBitOn(flags, 5)
+	extended.HasRestrictions = isBitOn(flags, 4)
+
+	pos := 6
+	field := func (name string, size int) ([]byte, error) {
+		if ((pos >= extended.Size) || (int(data[pos]) != size) || (pos + 1 + size > extended.Size)) {
+			return nil, newParseError(ErrBadExtendedHeader, fmt.Sprintf("bad %s data", name))
+		}
+		field_data := data[pos + 1:pos + 1 + size]
+		pos += 1 + size
+		return field_data, nil
+	}
+
+	if extended.Update {
+		_, err := field("update", 0)
+		if err != nil {
+			return extended, err
+		}
+	}
+	if extended.HasCRC {
+		crc, err := field("CRC", 5)
+		if err != nil {
+			return extended, err
+		}
+		extended.CRC = uint32(synchsafeBytesToInt(crc))
+	}
+	if extended.HasRestrictions {
+		restrictions, err := field("restrictions", 1)
+		if err != nil {
+			return extended, err
+		}
+		// %ppqrrstt
+		extended.Restrictions = TagRestrictions{
+			TagSize: int(restrictions[0] >> 6),
+			TextEncoding: int((restrictions[0] >> 5) & 1),
+			TextSize: int((restrictions[0] >> 3) & 3),
+			ImageEncoding: int((restrictions[0] >> 2) & 1),
+			ImageSize: int(restrictions[0] & 3),
+		}
 	}
-	return frames
+	return extended, nil
 }
 
-func v24ReadFrameHeader(reader *bufio.Reader) ID3v2FrameHeader {
+// v24RemoveFrameUnsync returns the frame with its body decoded, if
+// the frame is unsynchronised, and its unsynchronisation flag cleared.
+func v24RemoveFrameUnsync(frame ID3v2Frame, unsync bool) ID3v2Frame {
+	if ((unsync) || (frame.Header.Flags.Unsynchronised)) {
+		frame.Body = removeUnsync(frame.Body)
+		frame.Header.Flags.Unsynchronised = false
+		frame.Header.Size = len(frame.Body)
+	}
+	return frame
+}
+
+// v24ApplyFrameUnsync is the inverse of `v24RemoveFrameUnsync`. It
+// only unsynchronises the frame if its body needs it.
+func v24ApplyFrameUnsync(frame ID3v2Frame) ID3v2Frame {
+	if needsUnsync(frame.Body) {
+		frame.Body = applyUnsync(frame.Body)
+		frame.Header.Flags.Unsynchronised = true
+		frame.Header.Size = len(frame.Body)
+	}
+	return frame
+}
+
+// v24HasPlainFrameSizes returns true if the frames in the data only
+// follow on from each other when their sizes are read as plain
+// integers. Older versions of iTunes, among others, wrote v2.4 tags
+// like that. Sizes under 128 are the same either way, so it's only
+// when a tag has a larger frame that it makes a difference.
+func v24HasPlainFrameSizes(data []byte) bool {
+	synchsafe := func (size []byte) int {
+		if !isSynchsafe(size) {
+			return -1
+		}
+		return synchsafeBytesToInt(size)
+	}
+	if v24FramesFollowOn(data, synchsafe) {
+		return false
+	}
+	return v24FramesFollowOn(data, bytesToInt)
+}
+
+// v24FramesFollowOn returns true if, reading frame sizes with the given
+// function, each frame in the data is followed by another frame, by
+// padding, or by the end of the data. Padding is zeros to the end, as
+// a zero byte in the middle of a frame is no sign of anything.
+func v24FramesFollowOn(data []byte, size func([]byte) int) bool {
+	header_size := V24TAGIDSIZE + V24TAGSIZESIZE + V24TAGFLAGSSIZE
+	pos := 0
+	for pos < len(data) {
+		if data[pos] == 0 {
+			return len(bytes.Trim(data[pos:], "\x00")) == 0
+		}
+		if ((pos + header_size > len(data)) || (!areBytesValidFrameId(data[pos:pos + V24TAGIDSIZE]))) {
+			return false
+		}
+		n := size(data[pos + V24TAGIDSIZE:pos + V24TAGIDSIZE + V24TAGSIZESIZE])
+		if n < 0 {
+			return false
+		}
+		pos += header_size + n
+	}
+	return pos == len(data)
+}
+
+func v24ReadFrameHeader(reader *bufio.Reader, plain bool) (ID3v2FrameHeader, error) {
 	header := ID3v2FrameHeader{ }
-	header.Id = string(readBytes(reader, V24TAGIDSIZE))
-	header.Size = synchsafeBytesToInt(readBytes(reader, V24TAGSIZESIZE))
-	// Need to parse and appropriately handle these flags  @TODO
-	header.Flags = readBytes(reader, V24TAGFLAGSSIZE)
-	return header
+	id, err := readBytes(reader, V24TAGIDSIZE)
+	if err != nil {
+		return header, err
+	}
+	header.Id = string(id)
+	size, err := readBytes(reader, V24TAGSIZESIZE)
+	if err != nil {
+		return header, withFrameId(err, header.Id)
+	}
+	if plain {
+		header.Size = bytesToInt(size)
+	} else {
+		header.Size = synchsafeBytesToInt(size)
+	}
+	flags, err := readBytes(reader, V24TAGFLAGSSIZE)
+	if err != nil {
+		return header, withFrameId(err, header.Id)
+	}
+	header.Flags = v24ReadFrameFlags(flags)
+	return header, nil
+}
+
+// v24ReadFrameFlags decodes the two flag bytes of a frame header:
+// %0abc0000 %0h00kmnp
+// a: discard on tag alteration, b: discard on file alteration,
+// c: read only, h: grouped, k: compressed, m: encrypted,
+// n: unsynchronised, p: has a data length indicator
+func v24ReadFrameFlags(data []byte) FrameFlags {
+	return FrameFlags{
+		DiscardOnTagAlter: isBitOn(data[0], 6),
+		DiscardOnFileAlter: isBitOn(data[0], 5),
+		ReadOnly: isBitOn(data[0], 4),
+		Grouped: isBitOn(data[1], 6),
+		Compressed: isBitOn(data[1], 3),
+		Encrypted: isBitOn(data[1], 2),
+		Unsynchronised: isBitOn(data[1], 1),
+		HasDataLength: isBitOn(data[1], 0),
+	}
+}
+
+// v24MakeFrameFlagBytes is the inverse of `v24ReadFrameFlags`.
+func v24MakeFrameFlagBytes(flags FrameFlags) []byte {
+	var status, format byte
+	status = setBit(status, 6, flags.DiscardOnTagAlter)
+	status = setBit(status, 5, flags.DiscardOnFileAlter)
+	status = setBit(status, 4, flags.ReadOnly)
+	format = setBit(format, 6, flags.Grouped)
+	format = setBit(format, 3, flags.Compressed)
+	format = setBit(format, 2, flags.Encrypted)
+	format = setBit(format, 1, flags.Unsynchronised)
+	format = setBit(format, 0, flags.HasDataLength)
+	return []byte{status, format}
+}
+
+func v24MakeFrameHeaderBytes(header ID3v2FrameHeader) []byte {
+	var bytes []byte
+	bytes = append(bytes, []byte(header.Id)...)
+	bytes = append(bytes, synchsafeIntToBytes(header.Size)...)
+	bytes = append(bytes, v24MakeFrameFlagBytes(header.Flags)...)
+	return bytes
 }
 
-func v24PrintFrames(frames []ID3v2Frame) {
+func v24PrintFrames(out io.Writer, frames []ID3v2Frame, separator string) {
 	pull := func (part [2]string) (string, string) {
 		return part[0], part[1]
 	}
@@ -59,7 +301,7 @@ func v24PrintFrames(frames []ID3v2Frame) {
 
 	for _, frame := range frames {
 		if v24IsFrameEditable(keys, frame) {
-			fmt.Printf("%v: %v\n", keys[frame.Header.Id], parseString(frame.Body))
+			printFrameValues(out, keys[frame.Header.Id], frame, 4, separator)
 		}//  else {
 		// 	fmt.Printf("Frame is not text frame (%v)\n", frame.Header.Id)
 		// }
@@ -68,8 +310,8 @@ func v24PrintFrames(frames []ID3v2Frame) {
 
 // This function could be replaced with `makeFrameValidator(V24TAGIDSIZE)`
 func v24IsFrameEditable(keys map[string]string, frame ID3v2Frame) bool {
-	if ((len(frame.Header.Id) == V24TAGIDSIZE) &&
-		((frame.Header.Id[0:1] == "T") || (frame.Header.Id[0:1] == "W"))) {
+	if ((len(frame.Header.Id) == V24TAGIDSIZE) && (isFrameReadable(frame)) &&
+		((frame.Header.Id[0:1] == "T") || (frame.Header.Id[0:1] == "W") || isMainLangTextFrame(frame))) {
 		_, present := keys[frame.Header.Id]
 		return present
 	} else {
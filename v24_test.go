@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+
+// Frame sizes are read as plain integers only when the frames don't
+// follow on from each other as synchsafe ones. The PRIV frame is 300
+// bytes, which reads as 172 when synchsafe, and has a zero byte there
+// that isn't padding.
+func TestPlainFrameSizes(t *testing.T) {
+	body := make([]byte, 300)
+	for i := range body {
+		body[i] = 'x'
+	}
+	body[172] = 0
+	title := makeTestFrame(4, "TIT2", nil, []byte("\x00Title"))
+	plain := append(append([]byte("PRIV"), intToBytes(len(body), V24TAGSIZESIZE)...), 0, 0)
+	plain = append(plain, body...)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		plain bool
+	}{
+		{"plain", plain, true},
+		{"synchsafe", makeTestFrame(4, "PRIV", nil, body), false},
+	}
+	for _, test := range tests {
+		path := writeTestFile(t, makeTestTag(4, test.frame, title))
+		item, err := itemFromFile(path, Options{ })
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if item.Tag.PlainFrameSizes != test.plain {
+			t.Errorf("%s: plain frame sizes is %v", test.name, item.Tag.PlainFrameSizes)
+		}
+		if value := frameText(item.Tag.Frames, "TIT2"); value != "Title" {
+			t.Errorf("%s: TIT2 is %q", test.name, value)
+		}
+	}
+}
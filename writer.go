@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+
+// The padding given to a tag when its file has to be rewritten.
+const V2TAGPADDING = 2048
+
+
+// makeTagBytes returns the tag as it should be written to a file:
+// the header, the frames, `padding` zero bytes, and, if the header
+// calls for one, the footer. A tag with a footer can't have padding.
+// If the header's Unsynchronization flag is set, unsynchronisation is
+// applied where it's needed, and the flag is only written if it was.
+func makeTagBytes(tag ID3v2Tag, padding int) ([]byte, error) {
+	unsync := tag.Header.Unsynchronization
+	tag.Header.Unsynchronization = false
+
+	methods := readEncryptionMethods(tag.Frames)
+	var keyring map[string][]byte
+	if len(methods) > 0 {
+		var err error
+		keyring, err = readKeyring()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var frames []byte
+	for _, frame := range tag.Frames {
+		frame, err := makeFrameFormat(tag.Header.Version, frame, methods, keyring)
+		if err != nil {
+			return nil, err
+		}
+		if ((unsync) && (tag.Header.Version == 4)) {
+			frame = v24ApplyFrameUnsync(frame)
+		}
+		data, err := makeFrameBytes(tag.Header.Version, frame)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, data...)
+	}
+	if ((unsync) && (tag.Header.Version < 4) && (needsUnsync(frames))) {
+		frames = applyUnsync(frames)
+		tag.Header.Unsynchronization = true
+	}
+
+	footer := ((tag.Header.Version == 4) && (tag.Header.Footer))
+	if footer {
+		padding = 0
+	}
+
+	size := len(frames) + padding
+	if size > V2MAXSYNCHSAFEINT {
+		return nil, errors.New(fmt.Sprintf("Tag is too large to write (%d bytes).", size))
+	}
+
+	header, err := makeTagHeaderBytes("ID3", tag.Header, size)
+	if err != nil {
+		return nil, err
+	}
+
+	data := append(header, frames...)
+	data = append(data, make([]byte, padding)...)
+	if footer {
+		footer_data, _ := makeTagHeaderBytes("3DI", tag.Header, size)
+		data = append(data, footer_data...)
+	}
+
+	return data, nil
+}
+
+// makeTagHeaderBytes returns the ten bytes described by
+// `readV2TagHeader`. The identifier is "ID3" for a header and "3DI"
+// for a footer.
+func makeTagHeaderBytes(identifier string, header ID3v2TagHeader, size int) ([]byte, error) {
+	var flags byte
+	if header.Version == 2 {
+		flags = v22MakeTagHeaderFlags(header)
+	} else if header.Version == 3 {
+		flags = v23MakeTagHeaderFlags(header)
+	} else if header.Version == 4 {
+		flags = v24MakeTagHeaderFlags(header)
+	} else {
+		return nil, errors.New(fmt.Sprintf("Unrecognized tag version (%d).", header.Version))
+	}
+
+	data := []byte(identifier)
+	data = append(data, byte(header.Version), byte(header.MinorVersion), flags)
+	return append(data, synchsafeIntToBytes(size)...), nil
+}
+
+// makeFrameBytes returns the frame's header, formatted for the given
+// tag version, followed by its body.
+func makeFrameBytes(version int, frame ID3v2Frame) ([]byte, error) {
+	var header []byte
+	var max_size int
+	frame.Header.Size = len(frame.Body)
+
+	if version == 2 {
+		header = v22MakeFrameHeaderBytes(frame.Header)
+		max_size = (1 << 24) - 1
+	} else if version == 3 {
+		header = v23MakeFrameHeaderBytes(frame.Header)
+		max_size = V2MAXSYNCHSAFEINT
+	} else if version == 4 {
+		header = v24MakeFrameHeaderBytes(frame.Header)
+		max_size = V2MAXSYNCHSAFEINT
+	} else {
+		return nil, errors.New(fmt.Sprintf("Unrecognized tag version (%d).", version))
+	}
+
+	id_size := V23TAGIDSIZE
+	if version == 2 {
+		id_size = V22TAGIDSIZE
+	}
+	if ((len(frame.Header.Id) != id_size) || (!areBytesValidFrameId([]byte(frame.Header.Id)))) {
+		return nil, errors.New(fmt.Sprintf("Invalid frame ID for ID3v2.%d tag (%s).", version, frame.Header.Id))
+	}
+	if frame.Header.Size > max_size {
+		return nil, errors.New(fmt.Sprintf("Frame %s is too large to write (%d bytes).", frame.Header.Id, frame.Header.Size))
+	}
+
+	return append(header, frame.Body...), nil
+}
+
+// writeItem replaces the tag in the item's file with the item's tag.
+// The item's tag header must still describe the tag in the file. The
+// tag being replaced is first saved to the journal, and the write is
+// added to the journal's index once it has succeeded.
+func writeItem(item *Item, journal *Journal) error {
+	tag, in_place, err := makeItemTagBytes(item)
+	if err != nil {
+		return err
+	}
+
+	entry, err := journal.Backup(item.Path, tagFileSize(item.Tag.Header))
+	if err != nil {
+		return err
+	}
+
+	if in_place {
+		err = writeTagInPlace(item.Path, tag)
+	} else {
+		err = rewriteFile(item.Path, tag, tagFileSize(item.Tag.Header))
+	}
+	if err != nil {
+		journal.Discard(entry)
+		return err
+	}
+	// A backup that isn't in the index can't be found to undo the
+	// write, so it's removed.
+	err = journal.Commit(entry, tag)
+	if err != nil {
+		journal.Discard(entry)
+		return errors.New(fmt.Sprintf("The tag in '%s' was written, but can't be undone. %s", item.Path, err))
+	}
+	return nil
+}
+
+// makeItemTagBytes returns the bytes of the item's tag and whether
+// they can overwrite the tag in the file in place. That's possible
+// when the new tag fits in the space of the old tag, including its
+// padding, in which case the bytes are padded to fill that space
+// exactly. Otherwise the file must be rewritten, and the bytes are
+// given `V2TAGPADDING` bytes of padding so later edits can fit.
+func makeItemTagBytes(item *Item) ([]byte, bool, error) {
+	tag, err := makeTagBytes(item.Tag, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	old_size := tagFileSize(item.Tag.Header)
+	if len(tag) == old_size {
+		return tag, true, nil
+	}
+	if ((len(tag) < old_size) && (!item.Tag.Header.Footer)) {
+		tag, err = makeTagBytes(item.Tag, old_size - len(tag))
+		return tag, true, err
+	}
+
+	tag, err = makeTagBytes(item.Tag, V2TAGPADDING)
+	return tag, false, err
+}
+
+// writeTagInPlace overwrites the start of the file with the tag. The
+// tag must be the same size as the one it replaces.
+func writeTagInPlace(path string, tag []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't open file '%s' for writing (%s).", path, err))
+	}
+
+	_, err = file.WriteAt(tag, 0)
+	if err == nil {
+		err = file.Sync()
+	}
+	close_err := file.Close()
+	if err == nil {
+		err = close_err
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't write tag to '%s' (%s).", path, err))
+	}
+	return nil
+}
+
+// tagFileSize returns the number of bytes the tag with the given
+// header occupies in the file.
+func tagFileSize(header ID3v2TagHeader) int {
+	size := V2TAGHEADERSIZE + header.Size
+	if header.Footer {
+		size += V2TAGHEADERSIZE
+	}
+	return size
+}
+
+// rewriteFile writes the tag followed by the file's audio data, which
+// starts `old_size` bytes into the file, to a temporary file in the
+// same directory, and then renames that over the original.
+func rewriteFile(path string, tag []byte, old_size int) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't open file '%s' (%s).", path, err))
+	}
+	defer source.Close()
+
+	stats, err := source.Stat()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't stat file '%s' (%s).", path, err))
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't create temporary file for '%s' (%s).", path, err))
+	}
+
+	err = copyWithTag(temp, source, tag, old_size)
+	if err == nil {
+		err = temp.Chmod(stats.Mode())
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	close_err := temp.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+		return errors.New(fmt.Sprintf("Can't rewrite file '%s' (%s).", path, err))
+	}
+	return nil
+}
+
+func copyWithTag(dest io.Writer, source io.ReadSeeker, tag []byte, old_size int) error {
+	_, err := dest.Write(tag)
+	if err != nil {
+		return err
+	}
+	_, err = source.Seek(int64(old_size), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, source)
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+
+var testAudio = []byte{0xff, 0xfb, 0x90, 0x00, 0x01, 0x02, 0x03, 0x04}
+
+// makeTestFrames returns frames of each kind for a tag of the given
+// version: text with a false sync in it, a comment, user-defined
+// text, a picture, and text long enough to be compressed.
+func makeTestFrames(version int) []ID3v2Frame {
+	ids := []string{"TIT2", "COMM", "TXXX", "APIC", "TIT3"}
+	picture := "\x00image/jpeg\x00\x03\x00"
+	if version == 2 {
+		ids = []string{"TT2", "COM", "TXX", "PIC", "TT3"}
+		picture = "\x00JPG\x03\x00"
+	}
+	bodies := []string{
+		"\x00\xff\xe0Title",
+		"\x00eng\x00Comment",
+		"\x00Description\x00Value",
+		picture + "\xff\xd8\xff\xe0\x00\x10JFIF",
+		"\x00" + strings.Repeat("Long text ", 200),
+	}
+
+	var frames []ID3v2Frame
+	for i, id := range ids {
+		frames = append(frames, ID3v2Frame{Header: ID3v2FrameHeader{Id: id}, Body: []byte(bodies[i])})
+	}
+	return frames
+}
+
+// hasFalseSync returns true if the data has a byte sequence that looks
+// like the start of an MPEG frame.
+func hasFalseSync(data []byte) bool {
+	for i := 0; i + 1 < len(data); i++ {
+		if ((data[i] == 0xff) && (data[i + 1] >= 0xe0)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTestFile reads the file and checks that it holds the frames,
+// followed by the test audio.
+func checkTestFile(t *testing.T, name string, path string, want []ID3v2Frame) *Item {
+	item, err := itemFromFile(path, Options{ })
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	frames := item.Tag.Frames
+	if len(frames) != len(want) {
+		t.Fatalf("%s: read %d frames, want %d", name, len(frames), len(want))
+	}
+	for i := range frames {
+		if ((frames[i].Header.Id != want[i].Header.Id) || (!bytes.Equal(frames[i].Body, want[i].Body))) {
+			t.Errorf("%s: frame %d is %s %q, want %s %q", name, i, frames[i].Header.Id, frames[i].Body, want[i].Header.Id, want[i].Body)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, testAudio) {
+		t.Errorf("%s: the audio isn't at the end of the file", name)
+	}
+	return item
+}
+
+// Tags read back as they were written.
+func TestMakeTagBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []int
+		header   ID3v2TagHeader
+		compress bool
+	}{
+		{"plain", []int{2, 3, 4}, ID3v2TagHeader{ }, false},
+		{"footer", []int{4}, ID3v2TagHeader{Footer: true}, false},
+		{"unsync", []int{2, 3, 4}, ID3v2TagHeader{Unsynchronization: true}, false},
+		{"compress", []int{3, 4}, ID3v2TagHeader{ }, true},
+		{"all", []int{3, 4}, ID3v2TagHeader{Unsynchronization: true, Footer: true}, true},
+	}
+
+	for _, test := range tests {
+		for _, version := range test.versions {
+			name := test.name + " v2." + string(rune('0' + version))
+			tag := ID3v2Tag{Header: test.header, Frames: makeTestFrames(version)}
+			tag.Header.Version = version
+			if test.compress {
+				markFramesForCompression(&tag)
+			}
+			data, err := makeTagBytes(tag, 16)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if ((test.header.Unsynchronization) && (hasFalseSync(data))) {
+				t.Errorf("%s: the tag has a false sync", name)
+			}
+			if ((test.compress) && (len(data) > 1024)) {
+				t.Errorf("%s: the tag is %d bytes, so the long frame wasn't compressed", name, len(data))
+			}
+
+			path := writeTestFile(t, append(data, testAudio...))
+			item := checkTestFile(t, name, path, makeTestFrames(version))
+			if item.Tag.Header.Footer != ((test.header.Footer) && (version == 4)) {
+				t.Errorf("%s: the footer flag is %v", name, item.Tag.Header.Footer)
+			}
+			if ((test.compress) && (!item.Tag.Frames[4].Header.Flags.Compressed)) {
+				t.Errorf("%s: the long frame isn't marked compressed", name)
+			}
+		}
+	}
+}
+
+// A tag that still fits in the old tag's space is written in place,
+// and a larger one by rewriting the file.
+func TestWriteItem(t *testing.T) {
+	t.Setenv(JOURNALDIRENV, t.TempDir())
+	for _, version := range []int{2, 3, 4} {
+		name := "v2." + string(rune('0' + version))
+		data, err := makeTagBytes(ID3v2Tag{Header: ID3v2TagHeader{Version: version}, Frames: makeTestFrames(version)}, 16)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		path := writeTestFile(t, append(data, testAudio...))
+		item := checkTestFile(t, name, path, makeTestFrames(version))
+
+		journal, err := openJournal("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles := []string{"\x00New", "\x00" + strings.Repeat("New title ", 400)}
+		for i, title := range titles {
+			item.Tag.Frames[0].Body = []byte(title)
+			_, in_place, err := makeItemTagBytes(item)
+			if ((err != nil) || (in_place != (i == 0))) {
+				t.Errorf("%s: title %d is written in place: %v (%v)", name, i, in_place, err)
+			}
+			err = writeItem(item, journal)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			want := makeTestFrames(version)
+			want[0].Body = []byte(title)
+			item = checkTestFile(t, name, path, want)
+		}
+	}
+}